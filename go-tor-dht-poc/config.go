@@ -0,0 +1,496 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// nodeConfig is the TOML file given with -config. Zero values keep the command's defaults. See config.example.toml.
+type nodeConfig struct {
+	Impl    string        `toml:"impl"`
+	Debug   bool          `toml:"debug"`
+	Tor     torConfig     `toml:"tor"`
+	DHT     dhtConfig     `toml:"dht"`
+	Provide provideConfig `toml:"provide"`
+	Find    findConfig    `toml:"find"`
+	Daemon  daemonConfig  `toml:"daemon"`
+	// If set, provide and daemon serve each node's tordht.Status at /metrics on this host:port
+	MetricsAddr string `toml:"metrics_addr"`
+
+	// Set by validate
+	impl           tordht.Impl
+	bootstrapPeers []*tordht.PeerInfo
+	onionKey       ed25519.KeyPair
+	peerKey        []byte
+	swarmKey       []byte
+}
+
+// Maps to tor.StartConf
+type torConfig struct {
+	ExePath         string   `toml:"exe_path"`
+	DataDir         string   `toml:"data_dir"`
+	TorrcFile       string   `toml:"torrc_file"`
+	ExtraArgs       []string `toml:"extra_args"`
+	ControlPort     int      `toml:"control_port"`
+	NoAutoSocksPort bool     `toml:"no_auto_socks_port"`
+}
+
+// Maps to tordht.DHTConf and through it the transport
+type dhtConfig struct {
+	BootstrapPeers []string `toml:"bootstrap_peers"`
+	PeerCacheFile  string   `toml:"peer_cache_file"`
+	SwarmKeyFile   string   `toml:"swarm_key_file"`
+	// A file written by keygen, or the js web server's onion.pem
+	IdentityFile string `toml:"identity_file"`
+	// Only needed if the identity file is encrypted and TOR_DHT_POC_PASSPHRASE isn't set
+	IdentityPassphraseFile string                 `toml:"identity_passphrase_file"`
+	OnionIdentity          bool                   `toml:"onion_identity"`
+	ListenTimeout          configDuration         `toml:"listen_timeout"`
+	Security               string                 `toml:"security"`
+	Muxer                  string                 `toml:"muxer"`
+	AddrFormat             string                 `toml:"addr_format"`
+	I2P                    *i2pConfig             `toml:"i2p"`
+	Kademlia               *kademliaConfig        `toml:"kademlia"`
+	Maintenance            *maintenanceConfig     `toml:"maintenance"`
+	VerifyProviders        *verifyProvidersConfig `toml:"verify_providers"`
+	RateLimit              *rateLimitConfig       `toml:"rate_limit"`
+	DataID                 *dataIDConfig          `toml:"data_id"`
+}
+
+type i2pConfig struct {
+	SAMAddr string `toml:"sam_addr"`
+}
+
+type kademliaConfig struct {
+	BucketSize   int            `toml:"bucket_size"`
+	Alpha        int            `toml:"alpha"`
+	Replication  int            `toml:"replication"`
+	QueryTimeout configDuration `toml:"query_timeout"`
+	ProtocolID   string         `toml:"protocol_id"`
+}
+
+type maintenanceConfig struct {
+	MinRoutingTableSize int            `toml:"min_routing_table_size"`
+	CheckInterval       configDuration `toml:"check_interval"`
+	RefreshInterval     configDuration `toml:"refresh_interval"`
+}
+
+type verifyProvidersConfig struct {
+	Concurrency int            `toml:"concurrency"`
+	Timeout     configDuration `toml:"timeout"`
+}
+
+type rateLimitConfig struct {
+	RequestsPerSecond   float64 `toml:"requests_per_second"`
+	Burst               int     `toml:"burst"`
+	MaxProvidersPerPeer int     `toml:"max_providers_per_peer"`
+	Disabled            bool    `toml:"disabled"`
+}
+
+type dataIDConfig struct {
+	Namespace string `toml:"namespace"`
+	HashCode  uint64 `toml:"hash_code"`
+	Codec     uint64 `toml:"codec"`
+}
+
+type provideConfig struct {
+	Nodes     int      `toml:"nodes"`
+	Keys      []string `toml:"keys"`
+	KeysFile  string   `toml:"keys_file"`
+	ProvideOn string   `toml:"provide_on"`
+}
+
+type findConfig struct {
+	Key     string         `toml:"key"`
+	Max     int            `toml:"max"`
+	Timeout configDuration `toml:"timeout"`
+}
+
+type daemonConfig struct {
+	Socket    string         `toml:"socket"`
+	Reprovide configDuration `toml:"reprovide"`
+}
+
+// A duration in time.ParseDuration form
+type configDuration struct {
+	time.Duration
+}
+
+func (c *configDuration) UnmarshalText(text []byte) (err error) {
+	c.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// Collects every invalid field so they can all be fixed at once
+type configErrors []string
+
+func (c *configErrors) add(field string, format string, args ...interface{}) {
+	*c = append(*c, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (c configErrors) err() error {
+	if len(c) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid config:\n  %v", strings.Join(c, "\n  "))
+}
+
+// loadConfig parses and validates the file, loading any files it refers to
+func loadConfig(file string) (*nodeConfig, error) {
+	conf := &nodeConfig{}
+	meta, err := toml.DecodeFile(file, conf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing config %v: %v", file, err)
+	}
+	var errs configErrors
+	for _, key := range meta.Undecoded() {
+		errs.add(key.String(), "unknown field")
+	}
+	conf.validate(&errs)
+	return conf, errs.err()
+}
+
+func (c *nodeConfig) validate(errs *configErrors) {
+	implName := c.Impl
+	if implName == "" {
+		implName = defaultImpl
+	}
+	var err error
+	if c.impl, err = tordht.ImplByName(implName); err != nil {
+		errs.add("impl", "%v, expected one of: %v", err, strings.Join(tordht.ImplNames(), ", "))
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err = net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs.add("metrics_addr", "%v", err)
+		}
+	}
+	c.Tor.validate(errs)
+	c.DHT.validate(c, errs)
+	if c.Provide.Nodes < 0 {
+		errs.add("provide.nodes", "must be at least 1")
+	}
+	if c.Provide.ProvideOn != "" {
+		nodeCount := c.Provide.Nodes
+		if nodeCount == 0 {
+			nodeCount = participatingPeerCount
+		}
+		if _, err = parseNodes(c.Provide.ProvideOn, nodeCount); err != nil {
+			errs.add("provide.provide_on", "%v", err)
+		}
+	}
+	if c.Provide.KeysFile != "" {
+		if _, err = readKeysFile(c.Provide.KeysFile); err != nil {
+			errs.add("provide.keys_file", "%v", err)
+		}
+	}
+	if c.Find.Max < 0 {
+		errs.add("find.max", "must be at least 1")
+	}
+	if c.Find.Timeout.Duration < 0 {
+		errs.add("find.timeout", "cannot be negative")
+	}
+	if c.Daemon.Reprovide.Duration < 0 {
+		errs.add("daemon.reprovide", "cannot be negative")
+	}
+}
+
+func (t *torConfig) validate(errs *configErrors) {
+	if t.ExePath != "" {
+		if _, err := os.Stat(t.ExePath); err != nil {
+			errs.add("tor.exe_path", "%v", err)
+		}
+	}
+	if t.TorrcFile != "" {
+		if _, err := os.Stat(t.TorrcFile); err != nil {
+			errs.add("tor.torrc_file", "%v", err)
+		}
+	}
+	if t.ControlPort < 0 || t.ControlPort > 65535 {
+		errs.add("tor.control_port", "invalid port %v", t.ControlPort)
+	}
+}
+
+func (d *dhtConfig) validate(c *nodeConfig, errs *configErrors) {
+	for i, str := range d.BootstrapPeers {
+		if peer, err := tordht.NewPeerInfo(str); err != nil {
+			errs.add(fmt.Sprintf("dht.bootstrap_peers[%v]", i), "%v", err)
+		} else if c.impl != nil && peer.CheckImpl(c.impl) != nil {
+			errs.add(fmt.Sprintf("dht.bootstrap_peers[%v]", i), "%v", peer.CheckImpl(c.impl))
+		} else {
+			c.bootstrapPeers = append(c.bootstrapPeers, peer)
+		}
+	}
+	var err error
+	if d.SwarmKeyFile != "" {
+		if c.swarmKey, err = ioutil.ReadFile(d.SwarmKeyFile); err != nil {
+			errs.add("dht.swarm_key_file", "%v", err)
+		}
+	}
+	if d.IdentityFile != "" {
+		if id, err := loadIdentityFile(d.IdentityFile, d.IdentityPassphraseFile); err != nil {
+			errs.add("dht.identity_file", "%v", err)
+		} else if d.OnionIdentity && !id.OnionIdentity() {
+			errs.add("dht.identity_file", "has an onion key, onion_identity needs one from keygen -onion-identity")
+		} else if !d.OnionIdentity && id.OnionIdentity() {
+			errs.add("dht.identity_file", "has no onion key, it was made for onion_identity")
+		} else {
+			c.onionKey, c.peerKey = id.OnionKey, id.PeerKey
+		}
+	} else if d.IdentityPassphraseFile != "" {
+		errs.add("dht.identity_passphrase_file", "requires identity_file")
+	}
+	if d.ListenTimeout.Duration < 0 {
+		errs.add("dht.listen_timeout", "cannot be negative")
+	}
+	switch tordht.Security(d.Security) {
+	case "", tordht.SecurityDefault, tordht.SecurityNoise:
+	case tordht.SecurityNone:
+		if !d.OnionIdentity {
+			errs.add("dht.security", "'none' requires onion_identity")
+		}
+	default:
+		errs.add("dht.security", "unknown security '%v'", d.Security)
+	}
+	if muxer := tordht.Muxer(d.Muxer); muxer != "" && muxer != tordht.MuxerMplex && muxer != tordht.MuxerYamux {
+		errs.add("dht.muxer", "unknown muxer '%v'", d.Muxer)
+	}
+	switch tordht.AddrFormat(d.AddrFormat) {
+	case "", tordht.AddrFormatDNS, tordht.AddrFormatOnion3:
+	default:
+		errs.add("dht.addr_format", "unknown addr format '%v'", d.AddrFormat)
+	}
+	if k := d.Kademlia; k != nil {
+		if k.BucketSize < 0 {
+			errs.add("dht.kademlia.bucket_size", "cannot be negative")
+		}
+		if k.Alpha < 0 {
+			errs.add("dht.kademlia.alpha", "cannot be negative")
+		}
+		if k.Replication < 0 {
+			errs.add("dht.kademlia.replication", "cannot be negative")
+		}
+		if k.QueryTimeout.Duration < 0 {
+			errs.add("dht.kademlia.query_timeout", "cannot be negative")
+		}
+	}
+	if m := d.Maintenance; m != nil {
+		if m.MinRoutingTableSize < 0 {
+			errs.add("dht.maintenance.min_routing_table_size", "cannot be negative")
+		}
+		if m.CheckInterval.Duration < 0 {
+			errs.add("dht.maintenance.check_interval", "cannot be negative")
+		}
+		if m.RefreshInterval.Duration < 0 {
+			errs.add("dht.maintenance.refresh_interval", "cannot be negative")
+		}
+	}
+	if v := d.VerifyProviders; v != nil {
+		if v.Concurrency < 0 {
+			errs.add("dht.verify_providers.concurrency", "cannot be negative")
+		}
+		if v.Timeout.Duration < 0 {
+			errs.add("dht.verify_providers.timeout", "cannot be negative")
+		}
+	}
+	if r := d.RateLimit; r != nil {
+		if r.RequestsPerSecond < 0 {
+			errs.add("dht.rate_limit.requests_per_second", "cannot be negative")
+		}
+		if r.Burst < 0 {
+			errs.add("dht.rate_limit.burst", "cannot be negative")
+		}
+		if r.MaxProvidersPerPeer < 0 {
+			errs.add("dht.rate_limit.max_providers_per_peer", "cannot be negative")
+		}
+	}
+	if i := d.DataID; i != nil {
+		if _, ok := multihash.Codes[i.HashCode]; i.HashCode != 0 && !ok {
+			errs.add("dht.data_id.hash_code", "unknown multihash code %v", i.HashCode)
+		} else if _, err = multihash.Sum(nil, i.HashCode, -1); i.HashCode != 0 && err != nil {
+			errs.add("dht.data_id.hash_code", "%v", err)
+		}
+		if _, ok := cid.CodecToStr[i.Codec]; i.Codec != 0 && !ok {
+			errs.add("dht.data_id.codec", "unknown codec %v", i.Codec)
+		}
+	}
+	if c.impl != nil {
+		caps := c.impl.Capabilities()
+		if d.I2P != nil && !caps.I2P {
+			errs.add("dht.i2p", "not supported by the %v implementation", c.impl.Name())
+		}
+		if d.SwarmKeyFile != "" && !caps.SwarmKey {
+			errs.add("dht.swarm_key_file", "not supported by the %v implementation", c.impl.Name())
+		}
+		if d.PeerCacheFile != "" && !caps.PeerCache {
+			errs.add("dht.peer_cache_file", "not supported by the %v implementation", c.impl.Name())
+		}
+	}
+}
+
+// The defaults of the command's flags that the config sets
+func (c *nodeConfig) flagValues(cmd string) map[string][]string {
+	ret := map[string][]string{}
+	if c.Impl != "" {
+		ret["impl"] = []string{c.Impl}
+	}
+	if cmd == "provide" || cmd == "daemon" {
+		ret["peer"] = c.DHT.BootstrapPeers
+	}
+	if cmd == "provide" || cmd == "daemon" {
+		ret["key"] = c.Provide.Keys
+		if c.Provide.KeysFile != "" {
+			ret["keys-file"] = []string{c.Provide.KeysFile}
+		}
+	}
+	if cmd == "provide" {
+		if c.Provide.Nodes > 0 {
+			ret["nodes"] = []string{strconv.Itoa(c.Provide.Nodes)}
+		}
+		if c.Provide.ProvideOn != "" {
+			ret["provide-on"] = []string{c.Provide.ProvideOn}
+		}
+	} else if cmd == "find" {
+		if c.Find.Key != "" {
+			ret["key"] = []string{c.Find.Key}
+		}
+		if c.Find.Max > 0 {
+			ret["max"] = []string{strconv.Itoa(c.Find.Max)}
+		}
+		if c.Find.Timeout.Duration > 0 {
+			ret["timeout"] = []string{c.Find.Timeout.String()}
+		}
+	} else if cmd == "daemon" && c.Daemon.Reprovide.Duration > 0 {
+		ret["reprovide"] = []string{c.Daemon.Reprovide.String()}
+	}
+	if c.Daemon.Socket != "" {
+		ret["socket"] = []string{c.Daemon.Socket}
+	}
+	return ret
+}
+
+// Adds the -config flag. After parsing, call the returned func to load the config and use it for the flags that
+// weren't given.
+func configFlag(flags *flag.FlagSet) func() (*nodeConfig, error) {
+	file := flags.String("config", "", "A TOML config file, see config.example.toml")
+	return func() (*nodeConfig, error) {
+		conf := &nodeConfig{}
+		if *file != "" {
+			var err error
+			if conf, err = loadConfig(*file); err != nil {
+				return nil, err
+			}
+		}
+		debug = debug || conf.Debug
+		set := setFlags(flags)
+		for name, values := range conf.flagValues(flags.Name()) {
+			if set[name] || flags.Lookup(name) == nil {
+				continue
+			}
+			for _, value := range values {
+				if err := flags.Set(name, value); err != nil {
+					return nil, fmt.Errorf("Invalid config value for -%v: %v", name, err)
+				}
+			}
+		}
+		return conf, nil
+	}
+}
+
+// The tor start conf with the data dir defaulted
+func (c *nodeConfig) startConf(defaultDataDir string) *tor.StartConf {
+	ret := &tor.StartConf{
+		ExePath:         c.Tor.ExePath,
+		DataDir:         c.Tor.DataDir,
+		TorrcFile:       c.Tor.TorrcFile,
+		ExtraArgs:       c.Tor.ExtraArgs,
+		ControlPort:     c.Tor.ControlPort,
+		NoAutoSocksPort: c.Tor.NoAutoSocksPort,
+	}
+	if ret.DataDir == "" {
+		ret.DataDir = defaultDataDir
+	}
+	return ret
+}
+
+// The DHT conf without Tor and the bootstrap peers, which the commands set
+func (c *nodeConfig) dhtConf() *tordht.DHTConf {
+	d := c.DHT
+	ret := &tordht.DHTConf{
+		PeerCacheFile: d.PeerCacheFile,
+		Verbose:       debug,
+		SwarmKey:      c.swarmKey,
+		OnionIdentity: d.OnionIdentity,
+		OnionKey:      c.onionKey,
+		PeerKey:       c.peerKey,
+		ListenTimeout: d.ListenTimeout.Duration,
+		Security:      tordht.Security(d.Security),
+		Muxer:         tordht.Muxer(d.Muxer),
+		AddrFormat:    tordht.AddrFormat(d.AddrFormat),
+	}
+	if d.I2P != nil {
+		ret.I2P = &tordht.I2PConf{SAMAddr: d.I2P.SAMAddr}
+	}
+	if k := d.Kademlia; k != nil {
+		ret.Kademlia = &tordht.KademliaConf{
+			BucketSize:   k.BucketSize,
+			Alpha:        k.Alpha,
+			Replication:  k.Replication,
+			QueryTimeout: k.QueryTimeout.Duration,
+			ProtocolID:   k.ProtocolID,
+		}
+	}
+	if m := d.Maintenance; m != nil {
+		ret.Maintenance = &tordht.MaintenanceConf{
+			MinRoutingTableSize: m.MinRoutingTableSize,
+			CheckInterval:       m.CheckInterval.Duration,
+			RefreshInterval:     m.RefreshInterval.Duration,
+		}
+	}
+	if v := d.VerifyProviders; v != nil {
+		ret.VerifyProviders = &tordht.VerifyProvidersConf{Concurrency: v.Concurrency, Timeout: v.Timeout.Duration}
+	}
+	if r := d.RateLimit; r != nil {
+		ret.RateLimit = &tordht.RateLimitConf{
+			RequestsPerSecond:   r.RequestsPerSecond,
+			Burst:               r.Burst,
+			MaxProvidersPerPeer: r.MaxProvidersPerPeer,
+			Disabled:            r.Disabled,
+		}
+	}
+	if i := d.DataID; i != nil {
+		ret.DataID = &tordht.DataIDConf{Namespace: i.Namespace, HashCode: i.HashCode, Codec: i.Codec}
+	}
+	return ret
+}
+
+// Identity files can't be shared by multiple nodes
+func (c *nodeConfig) checkSingleNode(nodeCount int) error {
+	if nodeCount > 1 && (c.onionKey != nil || len(c.peerKey) > 0) {
+		return fmt.Errorf("The config's identity file can only be used with one node")
+	}
+	return nil
+}
+
+func configCommand(args []string) error {
+	if len(args) != 2 || args[0] != "check" {
+		return fmt.Errorf("Expected 'config check <file>'")
+	}
+	if _, err := loadConfig(args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Config %v is valid\n", args[1])
+	return nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+const daemonDataDir = "data-dir-temp-daemon"
+
+var defaultDaemonSocket = filepath.Join(daemonDataDir, "control.sock")
+
+// Provider records expire after a day on the other peers
+const defaultReprovideInterval = 12 * time.Hour
+
+// How long provide waits for the daemon's status and then for each key, the daemon's DHT put is over Tor
+const daemonStatusTimeout = 30 * time.Second
+const daemonProvideTimeout = 5 * time.Minute
+
+// Keys are given to the daemon either as a key that is hashed like the DHTs do or as an already hashed CID
+type daemonKeyRequest struct {
+	Key      string `json:"key,omitempty"`
+	CID      string `json:"cid,omitempty"`
+	Metadata []byte `json:"metadata,omitempty"`
+}
+
+type daemonFindRequest struct {
+	daemonKeyRequest
+	Max int `json:"max,omitempty"`
+	// In time.ParseDuration form, no limit if empty
+	Timeout string `json:"timeout,omitempty"`
+}
+
+type daemonFindResponse struct {
+	Providers []*tordht.PeerInfo `json:"providers"`
+}
+
+type daemonPeersResponse struct {
+	Self  *tordht.PeerInfo   `json:"self"`
+	Peers []*tordht.PeerInfo `json:"peers"`
+}
+
+type daemonStatusResponse struct {
+	Impl      string            `json:"impl"`
+	Self      *tordht.PeerInfo  `json:"self"`
+	Status    *tordht.Status    `json:"status"`
+	Providing []*daemonProvided `json:"providing"`
+}
+
+type daemonProvided struct {
+	Key          string    `json:"key,omitempty"`
+	CID          string    `json:"cid"`
+	Metadata     []byte    `json:"metadata,omitempty"`
+	LastProvided time.Time `json:"lastProvided"`
+}
+
+type daemonErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	socket := flags.String("socket", defaultDaemonSocket, "The control socket to listen on")
+	var keyStrs, peerStrs stringsFlag
+	flags.Var(&keyStrs, "key",
+		"A key to provide at start and keep providing, can be repeated. Escape = in the key as \\=.")
+	keysFile := flags.String("keys-file", "",
+		"A file of keys to provide at start, one per line in the same form as -key")
+	flags.Var(&peerStrs, "peer", "An existing peer to bootstrap from, can be repeated")
+	reprovideInterval := flags.Duration("reprovide", defaultReprovideInterval,
+		"How often the provided keys are provided again")
+	loadConf := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	nodeConf, err := loadConf()
+	if err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args, peers must be given with -peer")
+	} else if *reprovideInterval <= 0 {
+		return fmt.Errorf("Reprovide interval must be positive")
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
+	// Check before starting anything since that can take a while
+	if _, err = newDaemonClient(*socket); err == nil {
+		return fmt.Errorf("Daemon already running on %v", *socket)
+	}
+	dhtConf := nodeConf.dhtConf()
+	// The daemon hashes keys itself so it can be given CIDs too
+	d := &daemon{impl: impl, dataIDConf: dhtConf.DataID, provided: map[string]*daemonProvided{}}
+	dhtConf.DataID = &tordht.DataIDConf{Raw: true}
+	if dhtConf.BootstrapPeers, err = parsePeers(peerStrs, impl); err != nil {
+		return err
+	}
+	startProvided, err := d.startProvided(keyStrs, *keysFile)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	// Tor only creates its own data dir, which may not be where the socket goes
+	if err = os.MkdirAll(filepath.Dir(*socket), 0700); err != nil {
+		return fmt.Errorf("Failed creating socket dir: %v", err)
+	}
+
+	// Fire up tor
+	if dhtConf.Tor, err = startTor(ctx, impl, nodeConf.startConf(daemonDataDir)); err != nil {
+		return fmt.Errorf("Failed starting tor: %v", err)
+	}
+	defer dhtConf.Tor.Close()
+
+	log.Printf("Creating DHT\n")
+	if d.dht, err = impl.NewDHT(ctx, dhtConf); err != nil {
+		return fmt.Errorf("Failed creating DHT: %v", err)
+	}
+	defer d.dht.Close()
+	log.Printf("Created peer: %v\n", d.dht.PeerInfo())
+	// Nothing else uses provided until serving. Failures are kept so they're tried again on reprovide.
+	for _, provided := range startProvided {
+		if err = d.dht.Provide(ctx, []byte(provided.CID), nil); err != nil {
+			log.Printf("Failed providing key '%v', will try again on reprovide: %v\n", provided.Key, err)
+		} else {
+			provided.LastProvided = time.Now()
+			log.Printf("Providing %v\n", provided.CID)
+		}
+		d.provided[provided.CID] = provided
+	}
+
+	// Only we can use the socket. A leftover one from a daemon that didn't shut down cleanly is removed. Checked again
+	// in case another daemon started while we were.
+	if _, err = newDaemonClient(*socket); err == nil {
+		return fmt.Errorf("Daemon already running on %v", *socket)
+	}
+	os.Remove(*socket)
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		return fmt.Errorf("Failed listening on %v: %v", *socket, err)
+	}
+	defer os.Remove(*socket)
+	if err = os.Chmod(*socket, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("Failed setting socket permissions: %v", err)
+	}
+	server := &http.Server{Handler: d.handler()}
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- server.Serve(listener) }()
+	go d.reprovide(ctx, *reprovideInterval)
+	if nodeConf.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(nodeConf.MetricsAddr, []tordht.DHT{d.dht})
+		if err != nil {
+			server.Close()
+			return err
+		}
+		defer stopMetrics()
+	}
+	log.Printf("Listening on %v, interrupt to stop...\n", *socket)
+
+	// Run until interrupted or the server fails
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	select {
+	case sig := <-sigCh:
+		log.Printf("Got %v, stopping\n", sig)
+	case err = <-serveErrCh:
+		return fmt.Errorf("Failed serving: %v", err)
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer shutdownCancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+type daemon struct {
+	impl tordht.Impl
+	dht  tordht.DHT
+	// How keys are hashed, nil for defaults
+	dataIDConf *tordht.DataIDConf
+	// Keyed by CID
+	providedLock sync.Mutex
+	provided     map[string]*daemonProvided
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/provide", d.handlePost(d.provide))
+	mux.HandleFunc("/stop-providing", d.handlePost(d.stopProviding))
+	mux.HandleFunc("/find", d.handlePost(d.find))
+	mux.HandleFunc("/peers", d.handleGet(func() interface{} {
+		return &daemonPeersResponse{Self: d.dht.PeerInfo(), Peers: d.dht.Peers()}
+	}))
+	mux.HandleFunc("/status", d.handleGet(func() interface{} {
+		return &daemonStatusResponse{
+			Impl:      d.impl.Name(),
+			Self:      d.dht.PeerInfo(),
+			Status:    d.dht.Status(),
+			Providing: d.providing(),
+		}
+	}))
+	return mux
+}
+
+// An error with the HTTP status to respond with
+type daemonHTTPError struct {
+	status int
+	err    error
+}
+
+func (d *daemonHTTPError) Error() string { return d.err.Error() }
+
+func (d *daemon) handlePost(fn func(ctx context.Context, body []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeDaemonResponse(w, nil, &daemonHTTPError{http.StatusMethodNotAllowed, fmt.Errorf("Expected POST")})
+			return
+		}
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(http.MaxBytesReader(w, req.Body, 1<<20)); err != nil {
+			writeDaemonResponse(w, nil, badDaemonRequest("Failed reading body: %v", err))
+			return
+		}
+		resp, err := fn(req.Context(), body.Bytes())
+		writeDaemonResponse(w, resp, err)
+	}
+}
+
+func (d *daemon) handleGet(fn func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeDaemonResponse(w, nil, &daemonHTTPError{http.StatusMethodNotAllowed, fmt.Errorf("Expected GET")})
+			return
+		}
+		writeDaemonResponse(w, fn(), nil)
+	}
+}
+
+func writeDaemonResponse(w http.ResponseWriter, resp interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if httpErr, ok := err.(*daemonHTTPError); ok {
+			status = httpErr.status
+		}
+		w.WriteHeader(status)
+		resp = &daemonErrorResponse{Error: err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed writing response: %v", err)
+	}
+}
+
+func badDaemonRequest(format string, args ...interface{}) error {
+	return &daemonHTTPError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+// Returns the CID string of the key or CID in the request
+func (d *daemon) requestCID(req *daemonKeyRequest) (string, error) {
+	if req.Key != "" && req.CID != "" {
+		return "", badDaemonRequest("Cannot have both key and cid")
+	} else if req.Key != "" {
+		if cid, err := tordht.HashDataID([]byte(req.Key), d.dataIDConf); err != nil {
+			return "", badDaemonRequest("Invalid key: %v", err)
+		} else {
+			return cid.String(), nil
+		}
+	} else if req.CID == "" {
+		return "", badDaemonRequest("Missing key or cid")
+	} else if cid, err := tordht.HashDataID([]byte(req.CID), &tordht.DataIDConf{Raw: true}); err != nil {
+		return "", badDaemonRequest("%v", err)
+	} else {
+		return cid.String(), nil
+	}
+}
+
+func (d *daemon) provide(ctx context.Context, body []byte) (interface{}, error) {
+	var req daemonKeyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badDaemonRequest("Invalid request: %v", err)
+	}
+	cid, err := d.requestCID(&req)
+	if err != nil {
+		return nil, err
+	} else if len(req.Metadata) > tordht.MaxProviderMetadataSize {
+		return nil, badDaemonRequest("Metadata can be at most %v bytes", tordht.MaxProviderMetadataSize)
+	} else if err = d.dht.Provide(ctx, []byte(cid), req.Metadata); err != nil {
+		return nil, fmt.Errorf("Failed providing: %v", err)
+	}
+	provided := &daemonProvided{Key: req.Key, CID: cid, Metadata: req.Metadata, LastProvided: time.Now()}
+	d.providedLock.Lock()
+	d.provided[cid] = provided
+	d.providedLock.Unlock()
+	log.Printf("Providing %v\n", cid)
+	return provided, nil
+}
+
+// The keys given with -key and -keys-file, not provided yet
+func (d *daemon) startProvided(keyStrs []string, keysFile string) ([]*daemonProvided, error) {
+	if keysFile != "" {
+		fileKeys, err := readKeysFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keyStrs = append(keyStrs, fileKeys...)
+	}
+	keys, err := parseProvidedKeys(keyStrs, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*daemonProvided, 0, len(keys))
+	for _, key := range keys {
+		if key.override {
+			return nil, fmt.Errorf("Key '%v' can't be given nodes on the daemon", key.key)
+		}
+		cid, err := d.requestCID(&daemonKeyRequest{Key: key.key})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key '%v': %v", key.key, err)
+		}
+		ret = append(ret, &daemonProvided{Key: key.key, CID: cid})
+	}
+	return ret, nil
+}
+
+// The DHTs can't take back provider records, this just stops them from being provided again so they expire
+func (d *daemon) stopProviding(ctx context.Context, body []byte) (interface{}, error) {
+	var req daemonKeyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badDaemonRequest("Invalid request: %v", err)
+	}
+	cid, err := d.requestCID(&req)
+	if err != nil {
+		return nil, err
+	}
+	d.providedLock.Lock()
+	provided := d.provided[cid]
+	delete(d.provided, cid)
+	d.providedLock.Unlock()
+	if provided == nil {
+		return nil, &daemonHTTPError{http.StatusNotFound, fmt.Errorf("Not providing %v", cid)}
+	}
+	log.Printf("Stopped providing %v\n", cid)
+	return provided, nil
+}
+
+func (d *daemon) find(ctx context.Context, body []byte) (interface{}, error) {
+	var req daemonFindRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badDaemonRequest("Invalid request: %v", err)
+	}
+	cid, err := d.requestCID(&req.daemonKeyRequest)
+	if err != nil {
+		return nil, err
+	} else if req.Max <= 0 {
+		req.Max = 2
+	}
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			return nil, badDaemonRequest("Invalid timeout: %v", err)
+		}
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, timeout)
+		defer cancelFn()
+	}
+	providers, err := d.dht.FindProviders(ctx, []byte(cid), req.Max)
+	// Same as find, timing out before finding any is the same as not finding any
+	if len(providers) == 0 && err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("Failed finding providers: %v", err)
+	} else if providers == nil {
+		providers = []*tordht.PeerInfo{}
+	}
+	return &daemonFindResponse{Providers: providers}, nil
+}
+
+// Sorted by key then CID
+func (d *daemon) providing() []*daemonProvided {
+	d.providedLock.Lock()
+	ret := make([]*daemonProvided, 0, len(d.provided))
+	for _, provided := range d.provided {
+		copied := *provided
+		ret = append(ret, &copied)
+	}
+	d.providedLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Key != ret[j].Key {
+			return ret[i].Key < ret[j].Key
+		}
+		return ret[i].CID < ret[j].CID
+	})
+	return ret
+}
+
+// Provides everything again every interval until the context is done
+func (d *daemon) reprovide(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, provided := range d.providing() {
+			if err := d.dht.Provide(ctx, []byte(provided.CID), provided.Metadata); err != nil {
+				log.Printf("Failed providing %v again: %v", provided.CID, err)
+				continue
+			}
+			d.providedLock.Lock()
+			// Could have been stopped in the meantime
+			if current := d.provided[provided.CID]; current != nil {
+				current.LastProvided = time.Now()
+			}
+			d.providedLock.Unlock()
+		}
+	}
+}
+
+// daemonClient talks to a running daemon over its control socket
+type daemonClient struct {
+	socket string
+	client *http.Client
+}
+
+// Errors if nothing is listening on the socket
+func newDaemonClient(socket string) (*daemonClient, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("No socket")
+	}
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return &daemonClient{socket: socket, client: &http.Client{Transport: &http.Transport{DialContext: dial}}}, nil
+}
+
+// If req is nil, it is a GET
+func (d *daemonClient) call(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	method, body := http.MethodGet, &bytes.Buffer{}
+	if req != nil {
+		method = http.MethodPost
+		if err := json.NewEncoder(body).Encode(req); err != nil {
+			return err
+		}
+	}
+	httpReq, err := http.NewRequest(method, "http://daemon"+path, body)
+	if err != nil {
+		return err
+	}
+	httpResp, err := d.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Failed calling daemon on %v: %v", d.socket, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var errResp daemonErrorResponse
+		if err = json.NewDecoder(httpResp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("Daemon returned status %v", httpResp.StatusCode)
+		}
+		return fmt.Errorf("Daemon error: %v", errResp.Error)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (d *daemonClient) provide(ctx context.Context, req *daemonKeyRequest) (*daemonProvided, error) {
+	var resp daemonProvided
+	err := d.call(ctx, "/provide", req, &resp)
+	return &resp, err
+}
+
+func (d *daemonClient) find(ctx context.Context, req *daemonFindRequest) ([]*tordht.PeerInfo, error) {
+	var resp daemonFindResponse
+	err := d.call(ctx, "/find", req, &resp)
+	return resp.Providers, err
+}
+
+func (d *daemonClient) status(ctx context.Context) (*daemonStatusResponse, error) {
+	var resp daemonStatusResponse
+	err := d.call(ctx, "/status", nil, &resp)
+	return &resp, err
+}
+
+// Also fails if -impl was set and the daemon runs a different implementation
+func (d *daemonClient) checkedStatus(ctx context.Context, impl tordht.Impl, set map[string]bool) (
+	*daemonStatusResponse, error) {
+	if status, err := d.status(ctx); err != nil {
+		return nil, err
+	} else if set["impl"] && status.Impl != impl.Name() {
+		return nil, fmt.Errorf("Daemon is running implementation %v, not %v", status.Impl, impl.Name())
+	} else {
+		return status, nil
+	}
+}
+
+// Provides the keys on the daemon's node, the flags for local nodes can't be used
+func provideWithDaemon(client *daemonClient, impl tordht.Impl, set map[string]bool, keys []*providedKey,
+	format string) error {
+	for _, name := range []string{"nodes", "peer", "provide-on"} {
+		if set[name] {
+			return fmt.Errorf("-%v can't be used with a running daemon, give -socket '' to not use it", name)
+		}
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), daemonStatusTimeout)
+	status, err := client.checkedStatus(ctx, impl, set)
+	cancelFn()
+	if err != nil {
+		return err
+	}
+	provided := []string{}
+	for _, key := range keys {
+		if key.override {
+			return fmt.Errorf("Key '%v' can't be given nodes with a running daemon", key.key)
+		}
+		log.Printf("Providing key '%v' on the daemon (%v)\n", key.key, status.Self)
+		ctx, cancelFn = context.WithTimeout(context.Background(), daemonProvideTimeout)
+		_, err = client.provide(ctx, &daemonKeyRequest{Key: key.key})
+		cancelFn()
+		if err != nil {
+			return fmt.Errorf("Failed providing key '%v': %v", key.key, err)
+		}
+		provided = append(provided, key.key)
+	}
+	printProvidePeers([]*tordht.PeerInfo{status.Self}, [][]string{provided}, format)
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/keyfile"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const defaultIdentityFile = "identity.pem"
+
+// Used for encrypted identity files when there is no passphrase file
+const passphraseEnv = "TOR_DHT_POC_PASSPHRASE"
+
+func keygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	file := flags.String("file", defaultIdentityFile, "The identity file to write")
+	onionIdentity := flags.Bool("onion-identity", false,
+		"Only create a peer key and derive the onion key from it, for the ipfs impl's onion identity")
+	encrypt := flags.Bool("encrypt", false, "Encrypt the file with a passphrase")
+	force := flags.Bool("force", false, "Overwrite the file if it exists")
+	getPassphrase := passphraseFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args: %v", flags.Args())
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	} else if err = checkNotExists(*file, *force); err != nil {
+		return err
+	}
+	id, err := keyfile.Generate(*onionIdentity)
+	if err != nil {
+		return err
+	}
+	return saveIdentity(impl, *file, id, *encrypt, getPassphrase)
+}
+
+func identity(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Expected 'show', 'export', 'import' or 'rotate' subcommand")
+	} else if cmd, subArgs := args[0], args[1:]; cmd == "show" {
+		return identityShow(subArgs)
+	} else if cmd == "export" {
+		return identityExport(subArgs)
+	} else if cmd == "import" {
+		return identityImport(subArgs)
+	} else if cmd == "rotate" {
+		return identityRotate(subArgs)
+	} else {
+		return fmt.Errorf("Invalid identity subcommand '%v'", cmd)
+	}
+}
+
+func identityShow(args []string) error {
+	flags := flag.NewFlagSet("identity show", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	file := flags.String("file", defaultIdentityFile, "The identity file")
+	getPassphrase := passphraseFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args: %v", flags.Args())
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
+	id, passphrase, err := loadIdentity(*file, getPassphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Onion identity: %v, encrypted: %v\n", id.OnionIdentity(), len(passphrase) > 0)
+	return printIdentity(impl, id)
+}
+
+func identityExport(args []string) error {
+	flags := flag.NewFlagSet("identity export", flag.ContinueOnError)
+	file := flags.String("file", defaultIdentityFile, "The identity file")
+	format := flags.String("format", "pem", "'pem' for both keys unencrypted, 'onion' for an onion.pem the js web "+
+		"server can use, or 'tor' for a Tor hs_ed25519_secret_key file")
+	out := flags.String("out", "", "The file to write, stdout if empty")
+	getPassphrase := passphraseFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args: %v", flags.Args())
+	}
+	id, _, err := loadIdentity(*file, getPassphrase)
+	if err != nil {
+		return err
+	}
+	var byts []byte
+	if *format == "pem" {
+		byts, err = keyfile.Encode(id, nil)
+	} else if *format == "onion" || *format == "tor" {
+		// Onion identities have the onion key derived
+		onionKey, keyErr := id.OnionServiceKey()
+		if keyErr != nil {
+			return keyErr
+		} else if *format == "onion" {
+			byts, err = keyfile.Encode(&keyfile.Identity{OnionKey: onionKey}, nil)
+		} else {
+			byts = keyfile.EncodeTorSecretKey(onionKey)
+		}
+	} else {
+		return fmt.Errorf("Unknown format '%v'", *format)
+	}
+	if err != nil {
+		return err
+	} else if *out == "" {
+		_, err = os.Stdout.Write(byts)
+		return err
+	} else if err = ioutil.WriteFile(*out, byts, 0600); err != nil {
+		return fmt.Errorf("Failed writing %v: %v", *out, err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %v\n", *out)
+	return nil
+}
+
+func identityImport(args []string) error {
+	flags := flag.NewFlagSet("identity import", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	file := flags.String("file", defaultIdentityFile, "The identity file to write")
+	onionIdentity := flags.Bool("onion-identity", false,
+		"Don't generate an onion key if none was imported, it is derived from the peer key")
+	encrypt := flags.Bool("encrypt", false, "Encrypt the file with a passphrase")
+	force := flags.Bool("force", false, "Overwrite the file if it exists")
+	getPassphrase := passphraseFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() == 0 {
+		return fmt.Errorf("Expected files to import: onion.pem, Tor hs_ed25519_secret_key, or identity files")
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	} else if err = checkNotExists(*file, *force); err != nil {
+		return err
+	}
+	// The first onion and peer key found wins
+	id := &keyfile.Identity{}
+	for _, importFile := range flags.Args() {
+		byts, err := ioutil.ReadFile(importFile)
+		if err != nil {
+			return err
+		}
+		imported := &keyfile.Identity{}
+		if imported.OnionKey, err = keyfile.DecodeTorSecretKey(byts); err != nil {
+			if imported, _, err = decodeIdentity(importFile, byts, getPassphrase); err != nil {
+				return err
+			}
+		}
+		if id.OnionKey == nil {
+			id.OnionKey = imported.OnionKey
+		}
+		if len(id.PeerKey) == 0 {
+			id.PeerKey = imported.PeerKey
+		}
+	}
+	// Generate what's missing
+	if *onionIdentity && id.OnionKey != nil {
+		return fmt.Errorf("Cannot use -onion-identity, an onion key was imported")
+	} else if !*onionIdentity && id.OnionKey == nil {
+		fmt.Fprintf(os.Stderr, "No onion key imported, generating one\n")
+		generated, err := keyfile.Generate(false)
+		if err != nil {
+			return err
+		}
+		id.OnionKey = generated.OnionKey
+	}
+	if len(id.PeerKey) == 0 {
+		fmt.Fprintf(os.Stderr, "No peer key imported, generating one\n")
+		if id.PeerKey, err = keyfile.GeneratePeerKey(); err != nil {
+			return err
+		}
+	}
+	return saveIdentity(impl, *file, id, *encrypt, getPassphrase)
+}
+
+func identityRotate(args []string) error {
+	flags := flag.NewFlagSet("identity rotate", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	file := flags.String("file", defaultIdentityFile, "The identity file to rotate")
+	keepOnion := flags.Bool("keep-onion", false, "Only rotate the peer key, the onion stays the same")
+	keepPeer := flags.Bool("keep-peer", false, "Only rotate the onion key, the peer ID stays the same")
+	getPassphrase := passphraseFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args: %v", flags.Args())
+	} else if *keepOnion && *keepPeer {
+		return fmt.Errorf("Cannot keep both keys")
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
+	byts, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	oldID, passphrase, err := decodeIdentity(*file, byts, getPassphrase)
+	if err != nil {
+		return err
+	} else if oldID.OnionIdentity() && (*keepOnion || *keepPeer) {
+		return fmt.Errorf("Onion identities only have one key, cannot keep either")
+	}
+	oldPeer, err := identityPeerInfo(impl, oldID)
+	if err != nil {
+		return err
+	}
+	newID, err := keyfile.Generate(oldID.OnionIdentity())
+	if err != nil {
+		return err
+	} else if *keepOnion {
+		newID.OnionKey = oldID.OnionKey
+	} else if *keepPeer {
+		newID.PeerKey = oldID.PeerKey
+	}
+	newPeer, err := identityPeerInfo(impl, newID)
+	if err != nil {
+		return err
+	}
+	// Back up the old file as is, so it stays encrypted if it was
+	backupFile := *file + "." + time.Now().Format("20060102150405") + ".bak"
+	if err = ioutil.WriteFile(backupFile, byts, 0600); err != nil {
+		return fmt.Errorf("Failed backing up %v: %v", *file, err)
+	} else if err = keyfile.Save(*file, newID, passphrase); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up old identity to %v\n", backupFile)
+	fmt.Fprintf(os.Stderr, "A running daemon still uses the old identity until it is restarted\n")
+	fmt.Printf("old: %v\nnew: %v\n", oldPeer, newPeer)
+	return nil
+}
+
+// Adds the -passphrase-file flag, call the returned func after parsing to get the passphrase. It falls back to the
+// passphraseEnv env var then to prompting when stdin is a terminal, confirming the prompt if confirm is true.
+func passphraseFlag(flags *flag.FlagSet) func(confirm bool) ([]byte, error) {
+	file := flags.String("passphrase-file", "", "A file with the passphrase for encrypted identity files")
+	return func(confirm bool) ([]byte, error) {
+		return readPassphrase(*file, confirm)
+	}
+}
+
+func readPassphrase(file string, confirm bool) ([]byte, error) {
+	if file != "" {
+		if byts, err := ioutil.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("Failed reading passphrase file: %v", err)
+		} else if byts = bytes.TrimRight(byts, "\r\n"); len(byts) == 0 {
+			return nil, fmt.Errorf("Passphrase file %v is empty", file)
+		} else {
+			return byts, nil
+		}
+	} else if env := os.Getenv(passphraseEnv); env != "" {
+		return []byte(env), nil
+	} else if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("Passphrase required, give -passphrase-file or set %v", passphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading passphrase: %v", err)
+	} else if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Passphrase cannot be empty")
+	} else if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading passphrase: %v", err)
+		} else if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("Passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// Loads the identity file for the config, which can't prompt since the daemon may not have a terminal
+func loadIdentityFile(file string, passphraseFile string) (*keyfile.Identity, error) {
+	byts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	id, _, err := decodeIdentity(file, byts, func(bool) ([]byte, error) {
+		if passphraseFile == "" && os.Getenv(passphraseEnv) == "" {
+			return nil, fmt.Errorf("File is encrypted, set identity_passphrase_file or %v", passphraseEnv)
+		}
+		return readPassphrase(passphraseFile, false)
+	})
+	return id, err
+}
+
+// Also returns the passphrase if the file is encrypted
+func loadIdentity(file string, getPassphrase func(confirm bool) ([]byte, error)) (*keyfile.Identity, []byte, error) {
+	if byts, err := ioutil.ReadFile(file); err != nil {
+		return nil, nil, err
+	} else {
+		return decodeIdentity(file, byts, getPassphrase)
+	}
+}
+
+func decodeIdentity(
+	file string, byts []byte, getPassphrase func(confirm bool) ([]byte, error),
+) (*keyfile.Identity, []byte, error) {
+	var passphrase []byte
+	if keyfile.IsEncrypted(byts) {
+		var err error
+		if passphrase, err = getPassphrase(false); err != nil {
+			return nil, nil, err
+		}
+	}
+	if id, err := keyfile.Decode(byts, passphrase); err != nil {
+		return nil, nil, fmt.Errorf("Failed reading %v: %v", file, err)
+	} else {
+		return id, passphrase, nil
+	}
+}
+
+// Saves the identity and prints its peer info. Fails before saving if the impl can't use the identity.
+func saveIdentity(
+	impl tordht.Impl, file string, id *keyfile.Identity, encrypt bool, getPassphrase func(confirm bool) ([]byte, error),
+) error {
+	if _, err := identityPeerInfo(impl, id); err != nil {
+		return err
+	}
+	var passphrase []byte
+	if encrypt {
+		var err error
+		if passphrase, err = getPassphrase(true); err != nil {
+			return err
+		}
+	}
+	if err := keyfile.Save(file, id, passphrase); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote identity to %v\n", file)
+	return printIdentity(impl, id)
+}
+
+// The port is only known once listening so it is 0
+func printIdentity(impl tordht.Impl, id *keyfile.Identity) error {
+	if info, err := identityPeerInfo(impl, id); err != nil {
+		return err
+	} else {
+		fmt.Println(info)
+		return nil
+	}
+}
+
+func identityPeerInfo(impl tordht.Impl, id *keyfile.Identity) (*tordht.PeerInfo, error) {
+	info, err := impl.IdentityPeerInfo(&tordht.DHTConf{
+		OnionKey:      id.OnionKey,
+		PeerKey:       id.PeerKey,
+		OnionIdentity: id.OnionIdentity(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Identity not usable by the %v impl: %v", impl.Name(), err)
+	}
+	return info, nil
+}
+
+func checkNotExists(file string, force bool) error {
+	if _, err := os.Stat(file); err == nil && !force {
+		return fmt.Errorf("File %v exists, give -force to overwrite it", file)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -2,67 +2,271 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/cretz/bine/tor"
 	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
-	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/ipfs"
+	// Register the implementations
+	_ "github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/ipfs"
+	_ "github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/kad"
 )
 
-// Change to true to see lots of logs
-const debug = false
+// Change to true to see lots of logs, the config can also set it
+var debug = false
+
 const participatingPeerCount = 5
 const dataID = "tor-dht-poc-test"
-
-var impl tordht.Impl = ipfs.Impl
+const findDataDir = "data-dir-temp-find"
+const provideDataDir = "data-dir-temp-provide"
+const defaultImpl = "ipfs"
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatal(err)
+		code := 1
+		if exitErr, ok := err.(*exitError); ok {
+			code = exitErr.code
+		}
+		log.Print(err)
+		os.Exit(code)
 	}
 }
 
 func run() error {
 	if len(os.Args) < 2 {
-		return fmt.Errorf("Expected 'provide' or 'find' command")
+		return fmt.Errorf("Expected 'provide', 'find', 'rawid', 'daemon', 'config', 'keygen' or 'identity' command")
 	} else if cmd, subArgs := os.Args[1], os.Args[2:]; cmd == "provide" {
 		return provide(subArgs)
 	} else if cmd == "find" {
 		return find(subArgs)
 	} else if cmd == "rawid" {
 		return rawid(subArgs)
+	} else if cmd == "daemon" {
+		return runDaemon(subArgs)
+	} else if cmd == "config" {
+		return configCommand(subArgs)
+	} else if cmd == "keygen" {
+		return keygen(subArgs)
+	} else if cmd == "identity" {
+		return identity(subArgs)
 	} else {
 		return fmt.Errorf("Invalid command '%v'", cmd)
 	}
 }
 
+// Adds the --impl flag, call the returned func after parsing to get the impl
+func implFlag(flags *flag.FlagSet) func() (tordht.Impl, error) {
+	name := flags.String("impl", defaultImpl,
+		"The DHT implementation, one of: "+strings.Join(tordht.ImplNames(), ", "))
+	return func() (tordht.Impl, error) { return tordht.ImplByName(*name) }
+}
+
+// The names of the flags that were given
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	ret := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { ret[f.Name] = true })
+	return ret
+}
+
+// A repeatable string flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ", ") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+// Parses peers from the args, failing if they are for another impl
+func parsePeers(strs []string, impl tordht.Impl) ([]*tordht.PeerInfo, error) {
+	ret := make([]*tordht.PeerInfo, len(strs))
+	for i, str := range strs {
+		var err error
+		if ret[i], err = tordht.NewPeerInfo(str); err != nil {
+			return nil, fmt.Errorf("Failed parsing peer #%v: %v", i+1, err)
+		} else if err = ret[i].CheckImpl(impl); err != nil {
+			return nil, fmt.Errorf("Bad peer #%v: %v", i+1, err)
+		}
+	}
+	return ret, nil
+}
+
+// A key to provide and the 0-based indices of the nodes that provide it
+type providedKey struct {
+	key   string
+	nodes []int
+	// Whether the nodes were given instead of defaulted
+	override bool
+}
+
+// Keys are "<key>" or "<key>=<nodes>" where nodes are as parseNodes, the default nodes are used if not given. An
+// equals sign or backslash in the key is escaped with a backslash.
+func parseProvidedKeys(strs []string, defaultNodes []int, nodeCount int) ([]*providedKey, error) {
+	ret := make([]*providedKey, 0, len(strs))
+	for _, str := range strs {
+		key, nodesStr, hasNodes := splitProvidedKey(str)
+		k := &providedKey{key: key, nodes: defaultNodes}
+		if key == "" {
+			return nil, fmt.Errorf("Empty key in '%v'", str)
+		} else if hasNodes {
+			nodes, err := parseNodes(nodesStr, nodeCount)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid nodes for key '%v': %v", key, err)
+			}
+			k.nodes, k.override = nodes, true
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// Splits at the first unescaped equals sign, unescaping the key
+func splitProvidedKey(str string) (key string, nodes string, hasNodes bool) {
+	var keyBuf strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+1 < len(str) && (str[i+1] == '=' || str[i+1] == '\\') {
+			i++
+			keyBuf.WriteByte(str[i])
+		} else if str[i] == '=' {
+			return keyBuf.String(), str[i+1:], true
+		} else {
+			keyBuf.WriteByte(str[i])
+		}
+	}
+	return keyBuf.String(), "", false
+}
+
+// Nodes are comma-separated 1-based node numbers or "first", "last", or "all". Returns 0-based indices.
+func parseNodes(str string, nodeCount int) ([]int, error) {
+	ret := []int{}
+	seen := map[int]bool{}
+	add := func(index int) {
+		if !seen[index] {
+			seen[index] = true
+			ret = append(ret, index)
+		}
+	}
+	for _, piece := range strings.Split(str, ",") {
+		piece = strings.TrimSpace(piece)
+		if piece == "first" {
+			add(0)
+		} else if piece == "last" {
+			add(nodeCount - 1)
+		} else if piece == "all" {
+			for i := 0; i < nodeCount; i++ {
+				add(i)
+			}
+		} else if num, err := strconv.Atoi(piece); err != nil {
+			return nil, fmt.Errorf("Invalid node '%v'", piece)
+		} else if num < 1 || num > nodeCount {
+			return nil, fmt.Errorf("Node %v out of range, only have %v", num, nodeCount)
+		} else {
+			add(num - 1)
+		}
+	}
+	return ret, nil
+}
+
+// One key per line, blank lines and lines starting with # are ignored
+func readKeysFile(file string) ([]string, error) {
+	byts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading keys file: %v", err)
+	}
+	ret := []string{}
+	for _, line := range strings.Split(string(byts), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
+
 func provide(args []string) error {
-	if len(args) > 0 {
-		return fmt.Errorf("No args accepted for 'provide' currently")
+	flags := flag.NewFlagSet("provide", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	nodeCount := flags.Int("nodes", participatingPeerCount, "How many local nodes to create")
+	var keyStrs, peerStrs stringsFlag
+	flags.Var(&keyStrs, "key",
+		"A key to provide, can be repeated. Suffix with =<nodes> to override -provide-on. Escape = in the key as \\=.")
+	keysFile := flags.String("keys-file", "", "A file of keys to provide, one per line in the same form as -key")
+	flags.Var(&peerStrs, "peer", "An existing peer to bootstrap from, can be repeated")
+	provideOn := flags.String("provide-on", "first,last",
+		"The nodes that provide keys by default: comma-separated 1-based numbers, 'first', 'last', or 'all'")
+	format := flags.String("format", "text", "How to print the created peers, either 'text' or 'json'")
+	socket := flags.String("socket", defaultDaemonSocket,
+		"Provide on the daemon listening on this control socket if there is one, empty to never use a daemon")
+	loadConf := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	given := setFlags(flags)
+	nodeConf, err := loadConf()
+	if err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected args, peers must be given with -peer")
+	} else if *nodeCount < 1 {
+		return fmt.Errorf("Must have at least one node")
+	} else if *format != "text" && *format != "json" {
+		return fmt.Errorf("Invalid format '%v'", *format)
+	} else if err = nodeConf.checkSingleNode(*nodeCount); err != nil {
+		return err
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
+	bootstrapPeers, err := parsePeers(peerStrs, impl)
+	if err != nil {
+		return err
+	}
+	if *keysFile != "" {
+		fileKeys, err := readKeysFile(*keysFile)
+		if err != nil {
+			return err
+		}
+		keyStrs = append(keyStrs, fileKeys...)
+	}
+	if len(keyStrs) == 0 {
+		keyStrs = append(keyStrs, dataID)
+	}
+	defaultNodes, err := parseNodes(*provideOn, *nodeCount)
+	if err != nil {
+		return fmt.Errorf("Invalid -provide-on: %v", err)
+	}
+	keys, err := parseProvidedKeys(keyStrs, defaultNodes, *nodeCount)
+	if err != nil {
+		return err
+	}
+	// Use the running daemon instead if there is one
+	if client, err := newDaemonClient(*socket); err == nil {
+		return provideWithDaemon(client, impl, given, keys, *format)
 	}
 	ctx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
 
 	// Fire up tor
-	bineTor, err := startTor(ctx, "data-dir-temp-provide")
+	bineTor, err := startTor(ctx, impl, nodeConf.startConf(provideDataDir))
 	if err != nil {
 		return fmt.Errorf("Failed starting tor: %v", err)
 	}
 	defer bineTor.Close()
 
-	// Make multiple DHTs, passing the known set to the other ones for connecting
-	log.Printf("Creating %v peers", participatingPeerCount)
-	dhts := make([]tordht.DHT, participatingPeerCount)
-	prevPeers := []*tordht.PeerInfo{}
+	// Make multiple DHTs, passing the external peers and the known set to the other ones for connecting
+	log.Printf("Creating %v peers", *nodeCount)
+	dhts := make([]tordht.DHT, *nodeCount)
+	prevPeers := bootstrapPeers
 	for i := 0; i < len(dhts); i++ {
 		// Start DHT
-		conf := &tordht.DHTConf{
-			Tor:            bineTor,
-			Verbose:        debug,
-			BootstrapPeers: make([]*tordht.PeerInfo, len(prevPeers)),
-		}
+		conf := nodeConf.dhtConf()
+		conf.Tor = bineTor
+		conf.BootstrapPeers = make([]*tordht.PeerInfo, len(prevPeers))
 		copy(conf.BootstrapPeers, prevPeers)
 		dht, err := impl.NewDHT(ctx, conf)
 		if err != nil {
@@ -73,15 +277,32 @@ func provide(args []string) error {
 		prevPeers = append(prevPeers, dht.PeerInfo())
 		log.Printf("Created peer #%v: %v\n", i+1, dht.PeerInfo())
 	}
+	peers := make([]*tordht.PeerInfo, len(dhts))
+	for i, dht := range dhts {
+		peers[i] = dht.PeerInfo()
+	}
 
-	// Have a couple provide our key
-	log.Printf("Providing key on the first one (%v)\n", dhts[0].PeerInfo())
-	if err = dhts[0].Provide(ctx, []byte(dataID)); err != nil {
-		return fmt.Errorf("Failed providing on first: %v", err)
+	// Provide the keys on their nodes
+	provided := make([][]string, len(dhts))
+	for i := range provided {
+		provided[i] = []string{}
 	}
-	log.Printf("Providing key on the last one (%v)\n", dhts[len(dhts)-1].PeerInfo())
-	if err = dhts[len(dhts)-1].Provide(ctx, []byte(dataID)); err != nil {
-		return fmt.Errorf("Failed providing on last: %v", err)
+	for _, key := range keys {
+		for _, index := range key.nodes {
+			log.Printf("Providing key '%v' on peer #%v (%v)\n", key.key, index+1, dhts[index].PeerInfo())
+			if err = dhts[index].Provide(ctx, []byte(key.key), nil); err != nil {
+				return fmt.Errorf("Failed providing key '%v' on peer #%v: %v", key.key, index+1, err)
+			}
+			provided[index] = append(provided[index], key.key)
+		}
+	}
+	printProvidePeers(peers, provided, *format)
+	if nodeConf.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(nodeConf.MetricsAddr, dhts)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
 	}
 
 	// Wait for key press...
@@ -90,26 +311,119 @@ func provide(args []string) error {
 	return err
 }
 
+type providePeerJSON struct {
+	Node     int      `json:"node"`
+	Peer     string   `json:"peer"`
+	Provides []string `json:"provides"`
+}
+
+// Prints the peer addresses to stdout so they can be given to find
+func printProvidePeers(peers []*tordht.PeerInfo, provided [][]string, format string) {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for i, peer := range peers {
+			enc.Encode(&providePeerJSON{Node: i + 1, Peer: peer.String(), Provides: provided[i]})
+		}
+		return
+	}
+	for i, peer := range peers {
+		if len(provided[i]) == 0 {
+			fmt.Printf("%v\n", peer)
+		} else {
+			fmt.Printf("%v provides %v\n", peer, strings.Join(provided[i], ", "))
+		}
+	}
+}
+
+// Exit codes for find so scripts can tell failures apart
+const (
+	exitCodeNoProviders = 2
+	exitCodeJoinFailed  = 3
+)
+
+// An error that exits with a specific code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
 func find(args []string) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	key := flags.String("key", dataID, "The key to find providers for")
+	rawCID := flags.String("cid", "", "The raw CID to find providers for, as from 'rawid', instead of -key")
+	maxCount := flags.Int("max", 2, "The most providers to find")
+	timeout := flags.Duration("timeout", 0, "How long to try joining the DHT and finding, no limit if 0")
+	jsonOut := flags.Bool("json", false, "Print each provider as a JSON PeerInfo on its own line")
+	traceFormat := flags.String("trace", "", "Print the path of the lookup, either 'tree' or 'json'")
+	socket := flags.String("socket", defaultDaemonSocket,
+		"Find with the daemon listening on this control socket if there is one, empty to never use a daemon")
+	loadConf := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	given := setFlags(flags)
+	nodeConf, err := loadConf()
+	if err != nil {
+		return err
+	} else if *traceFormat != "" && *traceFormat != "tree" && *traceFormat != "json" {
+		return fmt.Errorf("Invalid trace format '%v'", *traceFormat)
+	} else if *maxCount < 1 {
+		return fmt.Errorf("Max must be at least 1")
+	}
+	if given["key"] && *rawCID != "" {
+		return fmt.Errorf("Cannot have both -key and -cid")
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
 	ctx, cancelFn := context.WithCancel(context.Background())
+	if *timeout > 0 {
+		ctx, cancelFn = context.WithTimeout(context.Background(), *timeout)
+	}
 	defer cancelFn()
 
-	// Get all the peers from the args
-	var err error
-	dhtConf := &tordht.DHTConf{
-		ClientOnly:     true,
-		Verbose:        debug,
-		BootstrapPeers: make([]*tordht.PeerInfo, len(args)),
-	}
-	for i := 0; i < len(args); i++ {
-		if dhtConf.BootstrapPeers[i], err = tordht.NewPeerInfo(args[i]); err != nil {
-			return fmt.Errorf("Failed parsing arg #%v: %v", i+1, err)
+	// Use the running daemon instead if there is one, the daemon can't trace though
+	if client, clientErr := newDaemonClient(*socket); clientErr == nil && *traceFormat == "" {
+		if flags.NArg() > 0 {
+			return fmt.Errorf("Peers can't be given when using a running daemon, give -socket '' to not use it")
+		} else if _, err = client.checkedStatus(ctx, impl, given); err != nil {
+			return err
+		}
+		req := &daemonFindRequest{daemonKeyRequest: daemonKeyRequest{Key: *key, CID: *rawCID}, Max: *maxCount}
+		if *rawCID != "" {
+			req.Key = ""
+		}
+		if *timeout > 0 {
+			req.Timeout = timeout.String()
 		}
+		providers, err := client.find(ctx, req)
+		return printProviders(ctx, providers, err, *jsonOut)
+	}
+
+	// Get all the peers from the args, they are only needed the first time since good peers are cached
+	dhtConf := nodeConf.dhtConf()
+	dhtConf.ClientOnly = true
+	if dhtConf.BootstrapPeers, err = parsePeers(flags.Args(), impl); err != nil {
+		return err
+	} else if len(dhtConf.BootstrapPeers) == 0 {
+		dhtConf.BootstrapPeers = nodeConf.bootstrapPeers
+	}
+	if impl.Capabilities().PeerCache && dhtConf.PeerCacheFile == "" {
+		dhtConf.PeerCacheFile = filepath.Join(findDataDir, "peers.json")
+	}
+	id := []byte(*key)
+	if *rawCID != "" {
+		id = []byte(*rawCID)
+		dhtConf.DataID = &tordht.DataIDConf{Raw: true}
 	}
 
 	// Fire up tor
-	if dhtConf.Tor, err = startTor(ctx, "data-dir-temp-find"); err != nil {
-		return fmt.Errorf("Failed starting tor: %v", err)
+	if dhtConf.Tor, err = startTor(ctx, impl, nodeConf.startConf(findDataDir)); err != nil {
+		return &exitError{exitCodeJoinFailed, fmt.Errorf("Failed starting tor: %v", err)}
 	}
 	defer dhtConf.Tor.Close()
 
@@ -117,22 +431,86 @@ func find(args []string) error {
 	log.Printf("Creating DHT and connecting to peers\n")
 	dht, err := impl.NewDHT(ctx, dhtConf)
 	if err != nil {
-		return fmt.Errorf("Failed creating DHT: %v", err)
+		return &exitError{exitCodeJoinFailed, fmt.Errorf("Failed creating DHT: %v", err)}
 	}
+	// Close to save the peer cache
+	defer dht.Close()
 
 	// Now find who is providing the id
-	providers, err := dht.FindProviders(ctx, []byte(dataID), 2)
-	if err != nil {
+	var trace *tordht.Trace
+	findCtx := ctx
+	if *traceFormat != "" {
+		findCtx, trace = tordht.WithTrace(ctx)
+	}
+	providers, err := dht.FindProviders(findCtx, id, *maxCount)
+	if trace != nil {
+		// Keep stdout for the providers in JSON mode
+		traceOut := os.Stdout
+		if *jsonOut {
+			traceOut = os.Stderr
+		}
+		if traceErr := printTrace(traceOut, trace, *traceFormat); traceErr != nil {
+			log.Printf("Failed printing trace: %v", traceErr)
+		}
+	}
+	return printProviders(ctx, providers, err, *jsonOut)
+}
+
+func printProviders(ctx context.Context, providers []*tordht.PeerInfo, err error, jsonOut bool) error {
+	// Timing out before finding any is the same as not finding any
+	if len(providers) == 0 && err != nil && ctx.Err() == nil {
 		return fmt.Errorf("Failed finding providers: %v", err)
+	} else if len(providers) == 0 {
+		return &exitError{exitCodeNoProviders, fmt.Errorf("No providers found")}
+	} else if err != nil {
+		log.Printf("Only found %v providers: %v", len(providers), err)
 	}
+	enc := json.NewEncoder(os.Stdout)
 	for _, provider := range providers {
-		log.Printf("Found data ID on %v\n", provider)
+		if !jsonOut {
+			log.Printf("Found data ID on %v\n", provider)
+		} else if err = enc.Encode(provider); err != nil {
+			return fmt.Errorf("Failed writing provider: %v", err)
+		}
 	}
 	return nil
 }
 
-func startTor(ctx context.Context, dataDir string) (*tor.Tor, error) {
-	startConf := &tor.StartConf{DataDir: dataDir}
+func printTrace(w io.Writer, trace *tordht.Trace, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(trace)
+	}
+	fmt.Fprintf(w, "Lookup of %v took %v\n", trace.Key, trace.Finished.Sub(trace.Started))
+	if trace.Error != "" {
+		fmt.Fprintf(w, "Error: %v\n", trace.Error)
+	}
+	// Children keyed by who they were learned from, the initial peers are under the empty string
+	children := map[string][]*tordht.TracePeer{}
+	for _, peer := range trace.Peers {
+		children[peer.LearnedFrom] = append(children[peer.LearnedFrom], peer)
+	}
+	var printPeers func(from string, indent string)
+	printPeers = func(from string, indent string) {
+		for _, peer := range children[from] {
+			status := "not queried"
+			if peer.Error != "" {
+				status = "error: " + peer.Error
+			} else if peer.Latency > 0 {
+				status = "replied in " + peer.Latency.String()
+			} else if !peer.Queried.IsZero() {
+				status = "no reply"
+			}
+			fmt.Fprintf(w, "%v- %v (hop %v, %v)\n", indent, peer.ID, peer.Hop, status)
+			printPeers(peer.ID, indent+"  ")
+		}
+	}
+	printPeers("", "")
+	return nil
+}
+
+func startTor(ctx context.Context, impl tordht.Impl, startConf *tor.StartConf) (*tor.Tor, error) {
 	if debug {
 		impl.ApplyDebugLogging()
 		startConf.NoHush = true
@@ -140,15 +518,3 @@ func startTor(ctx context.Context, dataDir string) (*tor.Tor, error) {
 	}
 	return tor.Start(ctx, startConf)
 }
-
-func rawid(args []string) error {
-	if len(args) > 0 {
-		return fmt.Errorf("No args accepted for 'rawid' currently")
-	}
-	str, err := impl.RawStringDataID([]byte(dataID))
-	if err != nil {
-		return err
-	}
-	fmt.Printf("Raw string ID: %v\n", str)
-	return nil
-}
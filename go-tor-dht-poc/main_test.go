@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+func TestParseProvidedKeys(t *testing.T) {
+	tests := []struct {
+		str      string
+		key      string
+		nodes    []int
+		override bool
+		// True if expected to fail
+		err bool
+	}{
+		{str: "plain", key: "plain", nodes: []int{0, 4}},
+		{str: "some-key=2,3", key: "some-key", nodes: []int{1, 2}, override: true},
+		{str: "some-key=last", key: "some-key", nodes: []int{4}, override: true},
+		{str: `a\=b`, key: "a=b", nodes: []int{0, 4}},
+		{str: `a\=b=first`, key: "a=b", nodes: []int{0}, override: true},
+		{str: `a\\=first`, key: `a\`, nodes: []int{0}, override: true},
+		{str: `a\b`, key: `a\b`, nodes: []int{0, 4}},
+		{str: "some-key=6", err: true},
+		{str: "some-key=nope", err: true},
+		{str: "some-key=", err: true},
+		{str: "a=b", err: true},
+		{str: "=1", err: true},
+	}
+	for _, test := range tests {
+		keys, err := parseProvidedKeys([]string{test.str}, []int{0, 4}, 5)
+		if test.err {
+			if err == nil {
+				t.Fatalf("Expected %v to fail, got key '%v'", test.str, keys[0].key)
+			}
+		} else if err != nil {
+			t.Fatalf("Failed parsing %v: %v", test.str, err)
+		} else if k := keys[0]; k.key != test.key || !reflect.DeepEqual(k.nodes, test.nodes) ||
+			k.override != test.override {
+			t.Fatalf("Expected %v to be '%v' on %v (override %v), got '%v' on %v (override %v)",
+				test.str, test.key, test.nodes, test.override, k.key, k.nodes, k.override)
+		}
+	}
+}
+
+func TestDaemonStartProvided(t *testing.T) {
+	d := &daemon{}
+	provided, err := d.startProvided([]string{"a", `b\=c`}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(provided) != 2 || provided[0].Key != "a" || provided[1].Key != "b=c" {
+		t.Fatalf("Unexpected keys: %v", provided)
+	}
+	for _, p := range provided {
+		if expected, _ := d.requestCID(&daemonKeyRequest{Key: p.Key}); p.CID != expected {
+			t.Fatalf("Expected CID %v for '%v', got %v", expected, p.Key, p.CID)
+		}
+	}
+	// The daemon is a single node
+	if _, err = d.startProvided([]string{"a=1"}, ""); err == nil {
+		t.Fatal("Expected failure for key with nodes")
+	}
+}
+
+func TestConfigMetricsAddr(t *testing.T) {
+	var errs configErrors
+	if (&nodeConfig{MetricsAddr: "127.0.0.1:9090"}).validate(&errs); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got: %v", errs)
+	}
+	(&nodeConfig{MetricsAddr: "no-port"}).validate(&errs)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "metrics_addr:") {
+		t.Fatalf("Expected only a metrics_addr error, got: %v", errs)
+	}
+}
+
+func TestConfigAddrFormat(t *testing.T) {
+	for _, format := range []string{"", "dns", "onion3"} {
+		var errs configErrors
+		if (&nodeConfig{DHT: dhtConfig{AddrFormat: format}}).validate(&errs); len(errs) != 0 {
+			t.Fatalf("Expected '%v' to be valid, got: %v", format, errs)
+		}
+	}
+	var errs configErrors
+	(&nodeConfig{DHT: dhtConfig{AddrFormat: "onion"}}).validate(&errs)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "dht.addr_format:") {
+		t.Fatalf("Expected only a dht.addr_format error, got: %v", errs)
+	}
+	conf := (&nodeConfig{DHT: dhtConfig{AddrFormat: "onion3"}}).dhtConf()
+	if conf.AddrFormat != tordht.AddrFormatOnion3 {
+		t.Fatalf("Expected addr format to be passed through, got '%v'", conf.AddrFormat)
+	}
+}
+
+func TestConfigCapabilities(t *testing.T) {
+	d := dhtConfig{I2P: &i2pConfig{}, PeerCacheFile: "peers.json"}
+	for _, name := range []string{"ipfs", "kad"} {
+		var errs configErrors
+		(&nodeConfig{Impl: name, DHT: d}).validate(&errs)
+		if name == "ipfs" && len(errs) != 0 {
+			t.Fatalf("Expected ipfs to support everything, got: %v", errs)
+		} else if name == "kad" && len(errs) != 2 {
+			t.Fatalf("Expected kad to reject I2P and the peer cache, got: %v", errs)
+		}
+	}
+}
+
+func TestConfigDataID(t *testing.T) {
+	tests := []struct {
+		dataID *dataIDConfig
+		// Empty if expected to be valid
+		field string
+	}{
+		{dataID: &dataIDConfig{}},
+		{dataID: &dataIDConfig{HashCode: multihash.SHA2_256, Codec: cid.DagProtobuf}},
+		{dataID: &dataIDConfig{HashCode: 12345}, field: "dht.data_id.hash_code"},
+		// Known, but hashing isn't supported
+		{dataID: &dataIDConfig{HashCode: multihash.Names["blake2s-24"]}, field: "dht.data_id.hash_code"},
+		{dataID: &dataIDConfig{Codec: 12345}, field: "dht.data_id.codec"},
+	}
+	for _, test := range tests {
+		var errs configErrors
+		(&nodeConfig{DHT: dhtConfig{DataID: test.dataID}}).validate(&errs)
+		if test.field == "" && len(errs) > 0 {
+			t.Fatalf("Expected %+v to be valid, got: %v", test.dataID, errs)
+		} else if test.field != "" && (len(errs) != 1 || !strings.HasPrefix(errs[0], test.field+":")) {
+			t.Fatalf("Expected only a %v error for %+v, got: %v", test.field, test.dataID, errs)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, []*tordht.Status{{RoutingTableSize: 3}, {Reconnects: 2, LastError: "failed"}})
+	for _, line := range []string{
+		"# TYPE tordht_routing_table_size gauge",
+		`tordht_routing_table_size{node="1"} 3`,
+		`tordht_routing_table_size{node="2"} 0`,
+		`tordht_reconnects_total{node="2"} 2`,
+		`tordht_last_error{node="2"} 1`,
+		`tordht_last_refresh_timestamp_seconds{node="1"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("Expected line %q in:\n%v", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// Starts serving the nodes' tordht.Status counters at /metrics in the Prometheus text format. Call the returned func
+// to stop.
+func serveMetrics(addr string, dhts []tordht.DHT) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listening for metrics on %v: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(dhts))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("Failed serving metrics: %v\n", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%v/metrics\n", listener.Addr())
+	return func() { server.Close() }, nil
+}
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(*tordht.Status) float64
+}
+
+var metrics = []*metric{
+	{"tordht_routing_table_size", "gauge", "Peers in the routing table",
+		func(s *tordht.Status) float64 { return float64(s.RoutingTableSize) }},
+	{"tordht_connected_peers", "gauge", "Peers with an open connection",
+		func(s *tordht.Status) float64 { return float64(s.ConnectedPeers) }},
+	{"tordht_reconnects_total", "counter", "Times peers were re-dialed because the routing table was too small",
+		func(s *tordht.Status) float64 { return float64(s.Reconnects) }},
+	{"tordht_rate_limited_requests_total", "counter", "Inbound requests rejected for the peer's rate limit",
+		func(s *tordht.Status) float64 { return float64(s.RateLimitedRequests) }},
+	{"tordht_rejected_providers_total", "counter", "Inbound provider records rejected for the peer's max",
+		func(s *tordht.Status) float64 { return float64(s.RejectedProviders) }},
+	{"tordht_last_refresh_timestamp_seconds", "gauge", "Unix time of the last refresh, 0 if never",
+		func(s *tordht.Status) float64 { return unixSeconds(s.LastRefresh) }},
+	{"tordht_last_reconnect_timestamp_seconds", "gauge", "Unix time of the last reconnect, 0 if never",
+		func(s *tordht.Status) float64 { return unixSeconds(s.LastReconnect) }},
+	{"tordht_last_error", "gauge", "1 if the last refresh or reconnect failed",
+		func(s *tordht.Status) float64 {
+			if s.LastError != "" {
+				return 1
+			}
+			return 0
+		}},
+}
+
+// Each node is labeled with its 1-based number
+func metricsHandler(dhts []tordht.DHT) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		statuses := make([]*tordht.Status, len(dhts))
+		for i, dht := range dhts {
+			statuses[i] = dht.Status()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, statuses)
+	})
+}
+
+func writeMetrics(w io.Writer, statuses []*tordht.Status) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.kind)
+		for i, status := range statuses {
+			fmt.Fprintf(w, "%v{node=\"%v\"} %v\n", m.name, i+1, m.value(status))
+		}
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
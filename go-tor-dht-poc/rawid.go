@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	multibase "github.com/multiformats/go-multibase"
+)
+
+// The bases rawid can print, in the order they are printed. The first is the one the DHTs use.
+var rawIDBases = []struct {
+	name     string
+	encoding multibase.Encoding
+}{
+	{"base58btc", multibase.Base58BTC},
+	{"base32", multibase.Base32},
+	{"base16", multibase.Base16},
+	{"base64", multibase.Base64},
+}
+
+// browserConfig is the JSON file the js web server gives to the page
+type browserConfig struct {
+	Keys           []*browserConfigKey `json:"keys"`
+	BootstrapPeers []string            `json:"bootstrapPeers"`
+}
+
+type browserConfigKey struct {
+	Key string `json:"key"`
+	CID string `json:"cid"`
+}
+
+func rawid(args []string) error {
+	flags := flag.NewFlagSet("rawid", flag.ContinueOnError)
+	getImpl := implFlag(flags)
+	base := flags.String("base", "", "Only print the CIDs in this base, one per line. Prints all bases if empty.")
+	var peerStrs stringsFlag
+	flags.Var(&peerStrs, "peer", "A bootstrap peer for the browser config, can be repeated")
+	browserConfigFile := flags.String("browser-config", "",
+		"Write the keys, CIDs and bootstrap peers to this JSON file for the js web server")
+	loadConf := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	nodeConf, err := loadConf()
+	if err != nil {
+		return err
+	}
+	impl, err := getImpl()
+	if err != nil {
+		return err
+	}
+	var onlyBase *multibase.Encoding
+	for i := range rawIDBases {
+		if rawIDBases[i].name == *base {
+			onlyBase = &rawIDBases[i].encoding
+		}
+	}
+	if *base != "" && onlyBase == nil {
+		return fmt.Errorf("Unknown base '%v'", *base)
+	}
+	// Keys are the args, or stdin if the only arg is "-"
+	keys := flags.Args()
+	if len(keys) == 1 && keys[0] == "-" {
+		if keys, err = readKeys(os.Stdin); err != nil {
+			return fmt.Errorf("Failed reading stdin: %v", err)
+		}
+	} else if len(keys) == 0 {
+		keys = []string{dataID}
+	}
+
+	dataIDConf := nodeConf.dhtConf().DataID
+	browserConf := &browserConfig{}
+	for _, key := range keys {
+		str, err := impl.RawStringDataID([]byte(key), dataIDConf)
+		if err != nil {
+			return fmt.Errorf("Failed creating ID for '%v': %v", key, err)
+		}
+		browserConf.Keys = append(browserConf.Keys, &browserConfigKey{Key: key, CID: str})
+		if onlyBase != nil {
+			encoded, err := cidInBase(str, *onlyBase)
+			if err != nil {
+				return err
+			}
+			fmt.Println(encoded)
+			continue
+		}
+		fmt.Printf("%v\n", key)
+		for _, b := range rawIDBases {
+			encoded, err := cidInBase(str, b.encoding)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("  %-10v %v\n", b.name+":", encoded)
+		}
+	}
+
+	if *browserConfigFile == "" {
+		return nil
+	} else if !impl.Capabilities().Browser {
+		return fmt.Errorf("The browser doesn't support the %v implementation", impl.Name())
+	}
+	peers, err := parsePeers(peerStrs, impl)
+	if err != nil {
+		return err
+	} else if len(peers) == 0 {
+		peers = nodeConf.bootstrapPeers
+	}
+	browserConf.BootstrapPeers = []string{}
+	for _, peer := range peers {
+		browserConf.BootstrapPeers = append(browserConf.BootstrapPeers, peer.String())
+	}
+	byts, err := json.MarshalIndent(browserConf, "", "  ")
+	if err != nil {
+		return err
+	} else if err = ioutil.WriteFile(*browserConfigFile, byts, 0644); err != nil {
+		return fmt.Errorf("Failed writing browser config: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote browser config to %v\n", *browserConfigFile)
+	return nil
+}
+
+func cidInBase(str string, base multibase.Encoding) (string, error) {
+	if c, err := cid.Decode(str); err != nil {
+		return "", fmt.Errorf("Invalid CID %v: %v", str, err)
+	} else {
+		return c.StringOfBase(base)
+	}
+}
+
+// One key per line, blank lines are ignored
+func readKeys(r io.Reader) ([]string, error) {
+	ret := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, scanner.Err()
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/cretz/bine/torutil"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/ipfs/sam"
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
 )
@@ -15,14 +16,62 @@ type addrFormat interface {
 	onionAddr(id string, port int) string
 }
 
-// var defaultAddrFormat addrFormat = addrFormatProtocol{}
-var defaultAddrFormat addrFormat = addrFormatDns{}
+// AddrFormat is the multiaddr encoding used when outputting onion addresses. All encodings are always accepted as
+// input.
+type AddrFormat int
 
-// In the form /onion/<onion-id>:<port>
+const (
+	// In the form /dns4/<onion-id>.onion/tcp/<port>
+	AddrFormatDNS AddrFormat = iota
+	// In the form /onion3/<onion-id>:<port>. The older /onion protocol only fits v2 onion IDs, so it is accepted on
+	// input but never output.
+	AddrFormatProtocol
+)
+
+var allAddrFormats = []addrFormat{addrFormatDns{}, addrFormatProtocol{}}
+
+func newAddrFormat(output AddrFormat) (addrFormat, error) {
+	switch output {
+	case AddrFormatDNS:
+		return addrFormatComposite{output: addrFormatDns{}, inputs: allAddrFormats}, nil
+	case AddrFormatProtocol:
+		return addrFormatComposite{output: addrFormatProtocol{}, inputs: allAddrFormats}, nil
+	default:
+		return nil, fmt.Errorf("Unknown addr format: %v", output)
+	}
+}
+
+// Accepts any of the inputs, outputs as the output
+type addrFormatComposite struct {
+	output addrFormat
+	inputs []addrFormat
+}
+
+func (a addrFormatComposite) onionInfo(addr ma.Multiaddr) (string, int, error) {
+	errs := make([]error, 0, len(a.inputs))
+	for _, input := range a.inputs {
+		if id, port, err := input.onionInfo(addr); err == nil {
+			return id, port, nil
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	return "", -1, fmt.Errorf("No supported onion format for %v: %v", addr, errs)
+}
+
+func (a addrFormatComposite) onionAddr(id string, port int) string {
+	return a.output.onionAddr(id, port)
+}
+
+// In the form /onion3/<onion-id>:<port>, also accepts /onion/<onion-id>:<port> on input
 type addrFormatProtocol struct{}
 
 func (addrFormatProtocol) onionInfo(addr ma.Multiaddr) (string, int, error) {
-	if onionAddrStr, err := addr.ValueForProtocol(ma.P_ONION); err != nil {
+	onionAddrStr, err := addr.ValueForProtocol(ma.P_ONION3)
+	if err != nil {
+		onionAddrStr, err = addr.ValueForProtocol(ma.P_ONION)
+	}
+	if err != nil {
 		return "", -1, fmt.Errorf("Failed getting onion info from %v: %v", addr, err)
 	} else if id, portStr, ok := torutil.PartitionString(onionAddrStr, ':'); !ok {
 		return "", -1, fmt.Errorf("Missing port on %v", onionAddrStr)
@@ -34,16 +83,16 @@ func (addrFormatProtocol) onionInfo(addr ma.Multiaddr) (string, int, error) {
 }
 
 func (addrFormatProtocol) onionAddr(id string, port int) string {
-	return fmt.Sprintf("/onion/%v:%v", id, port)
+	return fmt.Sprintf("/onion3/%v:%v", id, port)
 }
 
-// In the form /dns4/<onion-id>.onion/tcp/<port>
+// In the form /dns4/<onion-id>.onion/tcp/<port>, also accepts /dns6 on input
 type addrFormatDns struct{}
 
 func (addrFormatDns) onionInfo(addr ma.Multiaddr) (string, int, error) {
 	if addrPieces := ma.Split(addr); len(addrPieces) < 2 {
 		return "", -1, fmt.Errorf("Invalid pieces: %v", addrPieces)
-	} else if onionAddrStr, err := addrPieces[0].ValueForProtocol(madns.Dns4Protocol.Code); err != nil {
+	} else if onionAddrStr, err := dnsValue(addrPieces[0]); err != nil {
 		return "", -1, fmt.Errorf("Can't get onion part of %v: %v", addr, err)
 	} else if !strings.HasSuffix(onionAddrStr, ".onion") {
 		return "", -1, fmt.Errorf("Invalid onion addr: %v", onionAddrStr)
@@ -59,3 +108,27 @@ func (addrFormatDns) onionInfo(addr ma.Multiaddr) (string, int, error) {
 func (addrFormatDns) onionAddr(id string, port int) string {
 	return fmt.Sprintf("/dns4/%v.onion/tcp/%v", id, port)
 }
+
+func dnsValue(addr ma.Multiaddr) (string, error) {
+	if val, err := addr.ValueForProtocol(madns.Dns4Protocol.Code); err == nil {
+		return val, nil
+	}
+	return addr.ValueForProtocol(madns.Dns6Protocol.Code)
+}
+
+// In the form /i2p/<b32-hash>.b32.i2p, the "onion" ID is the full .b32.i2p address and the port is always 0
+type addrFormatI2P struct{}
+
+func (addrFormatI2P) onionInfo(addr ma.Multiaddr) (string, int, error) {
+	if i2pAddrStr, err := addr.ValueForProtocol(I2P_PROTO_CODE); err != nil {
+		return "", -1, fmt.Errorf("Failed getting I2P info from %v: %v", addr, err)
+	} else if !strings.HasSuffix(i2pAddrStr, sam.B32Suffix) {
+		return "", -1, fmt.Errorf("Invalid I2P addr: %v", i2pAddrStr)
+	} else {
+		return i2pAddrStr, 0, nil
+	}
+}
+
+func (addrFormatI2P) onionAddr(id string, port int) string {
+	return fmt.Sprintf("/i2p/%v", id)
+}
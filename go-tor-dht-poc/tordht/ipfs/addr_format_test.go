@@ -0,0 +1,106 @@
+package ipfs
+
+import (
+	"testing"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func testOnionID(t *testing.T) string {
+	key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torutil.OnionServiceIDFromV3PublicKey(key.PublicKey())
+}
+
+func TestAddrFormatRoundTrip(t *testing.T) {
+	id := testOnionID(t)
+	for _, output := range []AddrFormat{AddrFormatDNS, AddrFormatProtocol} {
+		format, err := newAddrFormat(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The composite output has to parse back, including with the websocket part after it
+		for _, suffix := range []string{"", "/ws"} {
+			addrStr := format.onionAddr(id, 1234) + suffix
+			if addr, err := ma.NewMultiaddr(addrStr); err != nil {
+				t.Fatalf("Format %v output %v doesn't parse: %v", output, addrStr, err)
+			} else if actualID, port, err := format.onionInfo(addr); err != nil {
+				t.Fatalf("Format %v can't read its own %v: %v", output, addrStr, err)
+			} else if actualID != id || port != 1234 {
+				t.Fatalf("Format %v read %v as %v:%v", output, addrStr, actualID, port)
+			}
+		}
+	}
+}
+
+func TestAddrFormatParse(t *testing.T) {
+	id := testOnionID(t)
+	v2ID := "abcdefghijklmnop"
+	format, err := newAddrFormat(AddrFormatDNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		// Empty if expected to fail
+		id   string
+		port int
+	}{
+		{addr: "/dns4/" + id + ".onion/tcp/80", id: id, port: 80},
+		{addr: "/dns6/" + id + ".onion/tcp/80", id: id, port: 80},
+		{addr: "/dns4/" + id + ".onion/tcp/80/ws", id: id, port: 80},
+		{addr: "/onion3/" + id + ":80", id: id, port: 80},
+		{addr: "/onion3/" + id + ":80/ws", id: id, port: 80},
+		{addr: "/onion/" + v2ID + ":80", id: v2ID, port: 80},
+		// Wrong or missing ports
+		{addr: "/dns4/" + id + ".onion/udp/80"},
+		{addr: "/dns4/" + id + ".onion"},
+		{addr: "/dns4/" + id + ".onion/ws"},
+		// Not onions
+		{addr: "/dns4/example.com/tcp/80"},
+		{addr: "/dns6/" + id + "/tcp/80"},
+		{addr: "/ip4/127.0.0.1/tcp/80"},
+		{addr: "/ip4/127.0.0.1/tcp/80/ws"},
+	}
+	for _, test := range tests {
+		addr, err := ma.NewMultiaddr(test.addr)
+		if err != nil {
+			t.Fatalf("Failed parsing %v: %v", test.addr, err)
+		}
+		actualID, port, err := format.onionInfo(addr)
+		if test.id == "" {
+			if err == nil {
+				t.Fatalf("Expected %v to fail, got %v:%v", test.addr, actualID, port)
+			}
+		} else if err != nil {
+			t.Fatalf("Failed reading %v: %v", test.addr, err)
+		} else if actualID != test.id || port != test.port {
+			t.Fatalf("Expected %v:%v from %v, got %v:%v", test.id, test.port, test.addr, actualID, port)
+		}
+	}
+}
+
+func TestAddrFormatMalformed(t *testing.T) {
+	id := testOnionID(t)
+	// These don't even make multiaddrs
+	for _, addrStr := range []string{
+		"/onion/" + id + ":80",
+		"/onion3/" + id,
+		"/onion3/" + id + ":0",
+		"/onion3/" + id + ":notaport",
+		"/onion3/" + id[:55] + ":80",
+		"/dns4/" + id + ".onion/tcp/notaport",
+		"/dns4",
+	} {
+		if _, err := ma.NewMultiaddr(addrStr); err == nil {
+			t.Fatalf("Expected %v to not parse", addrStr)
+		}
+	}
+	if _, err := newAddrFormat(AddrFormat(-1)); err == nil {
+		t.Fatal("Expected unknown format to fail")
+	}
+}
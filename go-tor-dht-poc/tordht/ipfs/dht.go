@@ -2,16 +2,20 @@ package ipfs
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
 	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
 	host "github.com/libp2p/go-libp2p-host"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
 
 	ma "github.com/multiformats/go-multiaddr"
 
@@ -19,14 +23,45 @@ import (
 )
 
 type torDHT struct {
-	debug    bool
-	tor      *tor.Tor
-	ipfsHost host.Host
-	ipfsDHT  *dht.IpfsDHT
-	peerInfo *tordht.PeerInfo
+	debug      bool
+	addrFormat addrFormat
+	dataIDConf *tordht.DataIDConf
+	ipfsHost   host.Host
+	ipfsDHT    *dht.IpfsDHT
+	peerInfo   *tordht.PeerInfo
+	// Nil if not listening on an onion service
+	onionKey ed25519.KeyPair
+	// Whether peer IDs are derived from onion keys
+	onionIdentity bool
+	protocolID    protocol.ID
+	// If 0, the DHT default is used
+	replication  int
+	queryTimeout time.Duration
+	// Nil if I2P is not used
+	i2pTransport *I2PTransport
+
+	bootstrapPeers    []*tordht.PeerInfo
+	maintenanceCancel context.CancelFunc
+	maintenanceDone   chan struct{}
+	// Guards status and recentPeers
+	statusLock  sync.Mutex
+	status      tordht.Status
+	recentPeers map[peer.ID]*recentPeer
+	// Nil if not persisting peers
+	peerCache *peerCache
+	// Nil if providers aren't dialed before returning
+	verifyProviders *tordht.VerifyProvidersConf
+	// Nil if inbound requests aren't limited
+	limiter *inboundLimiter
 }
 
 func (t *torDHT) Close() (err error) {
+	t.stopMaintenance()
+	if t.peerCache != nil {
+		if cacheErr := t.peerCache.save(); cacheErr != nil {
+			t.debugf("Failed saving peer cache: %v", cacheErr)
+		}
+	}
 	if t.ipfsDHT != nil {
 		err = t.ipfsDHT.Close()
 	}
@@ -36,36 +71,176 @@ func (t *torDHT) Close() (err error) {
 			err = hostCloseErr
 		}
 	}
+	if t.i2pTransport != nil {
+		if i2pCloseErr := t.i2pTransport.Close(); i2pCloseErr != nil {
+			// Just overwrite
+			err = i2pCloseErr
+		}
+	}
 	return
 }
 
 func (t *torDHT) PeerInfo() *tordht.PeerInfo { return t.peerInfo }
 
-func (t *torDHT) Provide(ctx context.Context, id []byte) error {
-	if cid, err := ipfsImpl.hashedCID(id); err != nil {
+func (t *torDHT) Provide(ctx context.Context, id []byte, metadata []byte) (err error) {
+	ctx, cancelFn := t.queryContext(ctx)
+	defer cancelFn()
+	cid, err := tordht.HashDataID(id, t.dataIDConf)
+	if err != nil {
 		return err
-	} else {
-		t.debugf("Providing CID: %v", cid)
-		return t.ipfsDHT.Provide(ctx, cid, true)
 	}
+	ctx, finishTrace := t.startTrace(ctx, cid)
+	defer func() { finishTrace(err) }()
+	if t.peerInfo == nil || t.onionKey == nil {
+		return fmt.Errorf("Must be listening on an onion service to provide")
+	} else if len(metadata) > tordht.MaxProviderMetadataSize {
+		return fmt.Errorf("Metadata is %v bytes, max is %v", len(metadata), tordht.MaxProviderMetadataSize)
+	}
+	// Put the signed record first so it's there for anyone that finds us as a provider
+	t.debugf("Putting provider record for CID: %v", cid)
+	peerKey := t.ipfsHost.Peerstore().PrivKey(t.ipfsHost.ID())
+	if rec, err := newProviderRecord(cid, t.peerInfo, metadata, t.onionKey, peerKey); err != nil {
+		return err
+	} else if recBytes, err := json.Marshal(rec); err != nil {
+		return err
+	} else if err = t.ipfsDHT.PutValue(ctx, providerRecordKey(cid, t.ipfsHost.ID()), recBytes); err != nil {
+		return fmt.Errorf("Failed putting provider record: %v", err)
+	}
+	t.debugf("Providing CID: %v", cid)
+	if t.replication > 0 {
+		return t.provideReplicated(ctx, cid)
+	}
+	return t.ipfsDHT.Provide(ctx, cid, true)
 }
 
-func (t *torDHT) FindProviders(ctx context.Context, id []byte, maxCount int) ([]*tordht.PeerInfo, error) {
-	cid, err := ipfsImpl.hashedCID(id)
+// How many provider records are fetched and checked at once, each is a DHT lookup
+const maxConcurrentProviderVerifies = 5
+
+// How many more candidates than the max are asked for, in case some don't verify
+const providerCandidateFactor = 2
+
+func (t *torDHT) FindProviders(ctx context.Context, id []byte, maxCount int) (ret []*tordht.PeerInfo, err error) {
+	ctx, cancelFn := t.queryContext(ctx)
+	defer cancelFn()
+	cid, err := tordht.HashDataID(id, t.dataIDConf)
 	if err != nil {
 		return nil, err
 	}
+	ctx, finishTrace := t.startTrace(ctx, cid)
+	defer func() { finishTrace(err) }()
 	t.debugf("Finding providers for CID: %v", cid)
+	ret = t.verifiedProviders(ctx, cid, maxCount)
+	if t.verifyProviders != nil && ctx.Err() == nil {
+		ret = t.liveProviders(ctx, ret)
+	}
+	return ret, ctx.Err()
+}
+
+// Verifies providers as the DHT finds them, a few at a time, until there are maxCount verified or the DHT has no more
+func (t *torDHT) verifiedProviders(ctx context.Context, c cid.Cid, maxCount int) []*tordht.PeerInfo {
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	sem := make(chan struct{}, maxConcurrentProviderVerifies)
+	verifiedCh := make(chan *tordht.PeerInfo)
+	var wg sync.WaitGroup
+	go func() {
+		for p := range t.ipfsDHT.FindProvidersAsync(ctx, c, maxCount*providerCandidateFactor) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				// The DHT closes the channel once it sees the context is done
+				continue
+			}
+			wg.Add(1)
+			go func(p peerstore.PeerInfo) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				// Forged or mismatched providers are dropped
+				if info, err := t.verifiedProvider(ctx, c, p); err != nil {
+					if ctx.Err() == nil {
+						t.debugf("Ignoring provider %v: %v", p.ID, err)
+					}
+				} else {
+					select {
+					case verifiedCh <- info:
+					case <-ctx.Done():
+					}
+				}
+			}(p)
+		}
+		wg.Wait()
+		close(verifiedCh)
+	}()
+	// Read until closed so no verification is left blocked, the rest stop once the context is done
 	ret := []*tordht.PeerInfo{}
-	for p := range t.ipfsDHT.FindProvidersAsync(ctx, cid, maxCount) {
-		if info, err := t.makePeerInfo(p.ID, p.Addrs[0]); err != nil {
-			// TODO: warn instead?
-			return nil, fmt.Errorf("Failed parsing '%v': %v", p, err)
-		} else {
+	for info := range verifiedCh {
+		if len(ret) < maxCount {
 			ret = append(ret, info)
 		}
+		if len(ret) >= maxCount {
+			cancelFn()
+		}
 	}
-	return ret, ctx.Err()
+	return ret
+}
+
+// Obtains the signed provider record for the provider and confirms it matches what the DHT gave us
+func (t *torDHT) verifiedProvider(ctx context.Context, c cid.Cid, p peerstore.PeerInfo) (*tordht.PeerInfo, error) {
+	recBytes, err := t.ipfsDHT.GetValue(ctx, providerRecordKey(c, p.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting provider record: %v", err)
+	}
+	rec, err := unmarshalProviderRecord(recBytes)
+	if err != nil {
+		return nil, err
+	} else if err = rec.verify(); err != nil {
+		return nil, err
+	} else if rec.CID != c.String() || rec.PeerID != p.ID.Pretty() {
+		return nil, fmt.Errorf("Provider record is for a different CID or peer")
+	} else if t.onionIdentity {
+		if expected, err := peerIDFromOnion(rec.OnionServiceID); err != nil {
+			return nil, err
+		} else if expected != p.ID {
+			return nil, fmt.Errorf("Onion %v is not for peer %v", rec.OnionServiceID, p.ID.Pretty())
+		}
+	}
+	// If the DHT gave us addresses, one has to be the signed onion
+	if len(p.Addrs) > 0 {
+		matched := false
+		for _, addr := range p.Addrs {
+			if onionID, port, err := t.addrFormat.onionInfo(addr); err == nil &&
+				onionID == rec.OnionServiceID && port == rec.OnionPort {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("Signed onion %v:%v not in provider addrs %v",
+				rec.OnionServiceID, rec.OnionPort, p.Addrs)
+		}
+	}
+	return rec.peerInfo(), nil
+}
+
+// Uses the first address that is in a supported onion format
+func (t *torDHT) makePeerInfoFromAddrs(id peer.ID, addrs []ma.Multiaddr) (*tordht.PeerInfo, error) {
+	errs := make([]error, 0, len(addrs))
+	for _, addr := range addrs {
+		if info, err := t.makePeerInfo(id, addr); err == nil {
+			return info, nil
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	return nil, fmt.Errorf("No usable onion address: %v", errs)
+}
+
+// Applies the query timeout if there is one
+func (t *torDHT) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.queryTimeout > 0 {
+		return context.WithTimeout(ctx, t.queryTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func (t *torDHT) debugf(format string, args ...interface{}) {
@@ -74,24 +249,34 @@ func (t *torDHT) debugf(format string, args ...interface{}) {
 	}
 }
 
+// Uses the onion address if listening on Tor, otherwise the I2P address. Our impl is put on it for others to check.
 func (t *torDHT) applyPeerInfo() error {
-	if listenAddrs := t.ipfsHost.Network().ListenAddresses(); len(listenAddrs) > 1 {
-		return fmt.Errorf("Expected at most 1 listen onion address, got %v", listenAddrs)
-	} else if len(listenAddrs) == 0 {
-		// no addr
-		return nil
-	} else if info, err := t.makePeerInfo(t.ipfsHost.ID(), listenAddrs[0]); err != nil {
-		return err
-	} else {
-		t.peerInfo = info
-		return nil
+	var infos []*tordht.PeerInfo
+	for _, listenAddr := range t.ipfsHost.Network().ListenAddresses() {
+		if info, err := t.makePeerInfo(t.ipfsHost.ID(), listenAddr); err != nil {
+			return err
+		} else {
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) > 2 || (len(infos) == 2 && infos[0].IsI2P() == infos[1].IsI2P()) {
+		return fmt.Errorf("Expected at most 1 listen address per network, got %v", infos)
+	}
+	for _, info := range infos {
+		if t.peerInfo == nil || !info.IsI2P() {
+			t.peerInfo = info
+		}
+	}
+	if t.peerInfo != nil {
+		t.peerInfo.Impl, t.peerInfo.ImplVersion = ipfsImpl.Name(), Version
 	}
+	return nil
 }
 
 func (t *torDHT) makePeerInfo(id peer.ID, addr ma.Multiaddr) (*tordht.PeerInfo, error) {
 	ret := &tordht.PeerInfo{ID: id.Pretty()}
 	var err error
-	if ret.OnionServiceID, ret.OnionPort, err = defaultAddrFormat.onionInfo(addr); err != nil {
+	if ret.OnionServiceID, ret.OnionPort, err = t.addrFormat.onionInfo(addr); err != nil {
 		return nil, err
 	}
 	return ret, nil
@@ -102,16 +287,22 @@ func (t *torDHT) connectPeers(ctx context.Context, peers []*tordht.PeerInfo, min
 		minRequired = len(peers)
 	}
 	t.debugf("Starting %v peer connections, waiting for at least %v", len(peers), minRequired)
-	// Connect to a bunch asynchronously
+	// Connect to a bunch asynchronously, a few at a time. Ones not started yet when we return never are.
+	sem := make(chan struct{}, maxConcurrentPeerConnects)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
 	peerConnCh := make(chan error, len(peers))
 	for _, peer := range peers {
-		// There may be an inexplicable race here so I sleep a tad
-		// TODO: investigate
-		time.Sleep(100 * time.Millisecond)
 		go func(peer *tordht.PeerInfo) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-doneCh:
+				return
+			}
 			t.debugf("Attempting to connect to peer %v", peer)
 			if err := t.connectPeer(ctx, peer); err != nil {
-				t.debugf("Failed connecting to peer %v: %v", err)
+				t.debugf("Failed connecting to peer %v: %v", peer, err)
 				peerConnCh <- fmt.Errorf("Peer connection to %v failed: %v", peer, err)
 			} else {
 				t.debugf("Successfully connected to peer %v", peer)
@@ -143,16 +334,31 @@ func (t *torDHT) connectPeers(ctx context.Context, peers []*tordht.PeerInfo, min
 }
 
 func (t *torDHT) connectPeer(ctx context.Context, peerInfo *tordht.PeerInfo) error {
-	if peer, err := t.addPeer(peerInfo); err != nil {
-		return err
-	} else {
-		return t.ipfsHost.Connect(ctx, *peer)
+	peer, err := t.addPeer(peerInfo)
+	if err == nil {
+		err = t.ipfsHost.Connect(ctx, *peer)
 	}
+	// The DHT only adds a peer to its routing table once it has confirmed the peer serves the DHT protocol, which
+	// happens in the background. Pinging confirms it now so a bootstrap right after has peers.
+	if err == nil {
+		if err = t.ipfsDHT.Ping(ctx, peer.ID); err != nil {
+			err = fmt.Errorf("Failed pinging: %v", err)
+		}
+	}
+	if t.peerCache != nil {
+		t.peerCache.record(peerInfo, err == nil)
+	}
+	return err
 }
 
 func (t *torDHT) addPeer(peerInfo *tordht.PeerInfo) (*peerstore.PeerInfo, error) {
+	// I2P peers don't use web sockets
 	ipfsAddrStr := fmt.Sprintf("%v/ws/ipfs/%v",
-		defaultAddrFormat.onionAddr(peerInfo.OnionServiceID, peerInfo.OnionPort), peerInfo.ID)
+		t.addrFormat.onionAddr(peerInfo.OnionServiceID, peerInfo.OnionPort), peerInfo.ID)
+	if peerInfo.IsI2P() {
+		ipfsAddrStr = fmt.Sprintf("%v/ipfs/%v",
+			addrFormatI2P{}.onionAddr(peerInfo.OnionServiceID, peerInfo.OnionPort), peerInfo.ID)
+	}
 	if ipfsAddr, err := addr.ParseString(ipfsAddrStr); err != nil {
 		return nil, err
 	} else if peer, err := peerstore.InfoFromP2pAddr(ipfsAddr.Multiaddr()); err != nil {
@@ -0,0 +1,22 @@
+package ipfs
+
+import (
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// Wraps the host given to the DHT so we control the DHT protocol's stream handler
+type dhtHost struct {
+	host.Host
+	protocolID protocol.ID
+	// Nil if inbound requests aren't limited
+	limiter *inboundLimiter
+}
+
+func (d *dhtHost) SetStreamHandler(pid protocol.ID, handler inet.StreamHandler) {
+	if pid == d.protocolID && d.limiter != nil {
+		handler = d.limiter.wrapHandler(handler)
+	}
+	d.Host.SetStreamHandler(pid, handler)
+}
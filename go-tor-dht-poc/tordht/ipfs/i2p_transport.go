@@ -0,0 +1,171 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/ipfs/sam"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-transport"
+	upgrader "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// impls libp2p's transport.Transport over an I2P SAM v3 bridge
+type I2PTransport struct {
+	conf       *I2PTransportConf
+	upgrader   *upgrader.Upgrader
+	addrFormat addrFormat
+
+	sessionLock sync.Mutex
+	session     *sam.Session
+}
+
+type I2PTransportConf struct {
+	// Defaults to 127.0.0.1:7656 if empty
+	SAMAddr string
+	// How long to wait for the session to be created. Defaults to 2 minutes.
+	SessionTimeout time.Duration
+	Verbose        bool
+}
+
+var _ transport.Transport = &I2PTransport{}
+
+func NewI2PTransport(conf *I2PTransportConf) func(*upgrader.Upgrader) (*I2PTransport, error) {
+	return func(upgrader *upgrader.Upgrader) (*I2PTransport, error) {
+		if conf == nil {
+			conf = &I2PTransportConf{}
+		}
+		// Make sure the protocols are there for parsing
+		if err := registerProtocols(); err != nil {
+			return nil, err
+		}
+		return &I2PTransport{conf: conf, upgrader: upgrader, addrFormat: addrFormatI2P{}}, nil
+	}
+}
+
+func (t *I2PTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	t.debugf("For peer ID %v, dialing %v", p, raddr)
+	b32Addr, _, err := t.addrFormat.onionInfo(raddr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := t.initSession(ctx)
+	if err != nil {
+		t.debugf("Failed initializing session: %v", err)
+		return nil, err
+	}
+	netConn, err := session.Dial(ctx, b32Addr)
+	if err != nil {
+		t.debugf("Failed dialing: %v", err)
+		return nil, err
+	}
+	// Convert connection
+	conn := &manetConn{Conn: netConn, remoteMultiaddr: raddr}
+	if conn.localMultiaddr, err = ma.NewMultiaddr(t.addrFormat.onionAddr(session.B32Addr, 0)); err != nil {
+		netConn.Close()
+		return nil, err
+	} else if upgraded, err := t.upgrader.UpgradeOutbound(ctx, t, conn, p); err != nil {
+		t.debugf("Failed upgrading connection: %v", err)
+		return nil, err
+	} else {
+		return upgraded, nil
+	}
+}
+
+func (t *I2PTransport) initSession(ctx context.Context) (*sam.Session, error) {
+	t.sessionLock.Lock()
+	defer t.sessionLock.Unlock()
+	// If already inited, good enough
+	if t.session != nil {
+		return t.session, nil
+	}
+	sessionTimeout := t.conf.SessionTimeout
+	if sessionTimeout == 0 {
+		sessionTimeout = 2 * time.Minute
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, sessionTimeout)
+	defer cancelFn()
+	var err error
+	if t.session, err = sam.NewSession(ctx, t.conf.SAMAddr); err != nil {
+		return nil, fmt.Errorf("Failed creating I2P session: %v", err)
+	}
+	t.debugf("Created I2P session for %v", t.session.B32Addr)
+	return t.session, nil
+}
+
+func (t *I2PTransport) CanDial(addr ma.Multiaddr) bool {
+	t.debugf("Checking if can dial %v", addr)
+	_, _, err := t.addrFormat.onionInfo(addr)
+	return err == nil
+}
+
+func (t *I2PTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	t.debugf("Called listen for %v", laddr)
+	if val, err := laddr.ValueForProtocol(I2P_LISTEN_PROTO_CODE); err != nil {
+		return nil, fmt.Errorf("Unable to get protocol value: %v", err)
+	} else if val != "" {
+		return nil, fmt.Errorf("Must be '/i2pListen', got '/i2pListen/%v'", val)
+	}
+	session, err := t.initSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	manetListen := &i2pManetListener{transport: t, listener: session.Listen()}
+	if manetListen.multiaddr, err = ma.NewMultiaddr(t.addrFormat.onionAddr(session.B32Addr, 0)); err != nil {
+		return nil, fmt.Errorf("Failed converting I2P address: %v", err)
+	}
+	t.debugf("Completed creating IPFS listener from I2P, addr: %v", manetListen.multiaddr)
+	return t.upgrader.UpgradeListener(t, manetListen), nil
+}
+
+func (t *I2PTransport) Protocols() []int { return []int{I2P_PROTO_CODE, I2P_LISTEN_PROTO_CODE} }
+func (t *I2PTransport) Proxy() bool      { return true }
+
+// Close closes the SAM session if one was created.
+func (t *I2PTransport) Close() error {
+	t.sessionLock.Lock()
+	defer t.sessionLock.Unlock()
+	if t.session == nil {
+		return nil
+	}
+	err := t.session.Close()
+	t.session = nil
+	return err
+}
+
+func (t *I2PTransport) debugf(format string, args ...interface{}) {
+	if t.conf.Verbose {
+		log.Printf("[DEBUG] [I2P] "+format, args...)
+	}
+}
+
+type i2pManetListener struct {
+	transport *I2PTransport
+	multiaddr ma.Multiaddr
+	listener  net.Listener
+}
+
+func (i *i2pManetListener) Accept() (manet.Conn, error) {
+	if c, err := i.listener.Accept(); err != nil {
+		return nil, err
+	} else {
+		// Erroring here would close the whole listener, so like Tor, a bad remote address just uses ours
+		ret := &manetConn{Conn: c, localMultiaddr: i.multiaddr, remoteMultiaddr: i.multiaddr}
+		remoteAddrStr := i.transport.addrFormat.onionAddr(c.RemoteAddr().String(), 0)
+		if remote, err := ma.NewMultiaddr(remoteAddrStr); err != nil {
+			i.transport.debugf("Failed converting remote address %v: %v", c.RemoteAddr(), err)
+		} else {
+			ret.remoteMultiaddr = remote
+		}
+		return ret, nil
+	}
+}
+func (i *i2pManetListener) Close() error            { return i.listener.Close() }
+func (i *i2pManetListener) Addr() net.Addr          { return i.listener.Addr() }
+func (i *i2pManetListener) Multiaddr() ma.Multiaddr { return i.multiaddr }
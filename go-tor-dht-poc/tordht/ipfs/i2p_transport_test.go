@@ -0,0 +1,66 @@
+package ipfs
+
+import (
+	"net"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestTorTransportParsesI2PAddrs(t *testing.T) {
+	if _, err := NewTorTransport(nil, nil)(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.NewMultiaddr("/i2p/" + testOnionID(t)); err != nil {
+		t.Fatalf("Expected I2P address to parse with only the Tor transport: %v", err)
+	}
+}
+
+type badRemoteAddr struct{}
+
+func (badRemoteAddr) Network() string { return "i2p" }
+func (badRemoteAddr) String() string  { return "not/an/i2p/addr" }
+
+type badRemoteConn struct{ net.Conn }
+
+func (badRemoteConn) RemoteAddr() net.Addr { return badRemoteAddr{} }
+
+type badRemoteListener struct{ net.Listener }
+
+func (b badRemoteListener) Accept() (net.Conn, error) {
+	c, err := b.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return badRemoteConn{c}, nil
+}
+
+func TestI2PListenerAcceptsBadRemoteAddr(t *testing.T) {
+	listenAddr, err := i2pListenAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &i2pManetListener{
+		transport: &I2PTransport{conf: &I2PTransportConf{}, addrFormat: addrFormatI2P{}},
+		multiaddr: listenAddr,
+		listener:  badRemoteListener{netListener},
+	}
+	defer listener.Close()
+	go func() {
+		if c, err := net.Dial("tcp", netListener.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Expected conn with a bad remote address to be accepted: %v", err)
+	}
+	defer conn.Close()
+	if !conn.RemoteMultiaddr().Equal(listenAddr) {
+		t.Fatalf("Expected remote address to fall back to %v, got %v", listenAddr, conn.RemoteMultiaddr())
+	}
+}
@@ -0,0 +1,85 @@
+package ipfs
+
+import (
+	"fmt"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	stded25519 "golang.org/x/crypto/ed25519"
+)
+
+// Generates an onion service key and the libp2p key from the same ed25519 key. Tor only uses the expanded form of the
+// key so it has to be derived from a regular key and not the other way around.
+func generateOnionIdentity() (ed25519.KeyPair, crypto.PrivKey, error) {
+	_, key, err := stded25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed generating key: %v", err)
+	}
+	return onionIdentityFromKey(key)
+}
+
+// The peer key must be a marshaled Ed25519 libp2p key
+func onionIdentityFromPeerKey(peerKey []byte) (ed25519.KeyPair, crypto.PrivKey, error) {
+	if privKey, err := crypto.UnmarshalPrivateKey(peerKey); err != nil {
+		return nil, nil, fmt.Errorf("Invalid peer key: %v", err)
+	} else if _, ok := privKey.(*crypto.Ed25519PrivateKey); !ok {
+		return nil, nil, fmt.Errorf("Peer key must be Ed25519 for onion identity")
+	} else if raw, err := privKey.Raw(); err != nil {
+		return nil, nil, fmt.Errorf("Failed reading peer key: %v", err)
+	} else {
+		return onionIdentityFromKey(stded25519.PrivateKey(raw))
+	}
+}
+
+func onionIdentityFromKey(key stded25519.PrivateKey) (ed25519.KeyPair, crypto.PrivKey, error) {
+	if privKey, err := crypto.UnmarshalEd25519PrivateKey(key); err != nil {
+		return nil, nil, fmt.Errorf("Failed converting key: %v", err)
+	} else {
+		return ed25519.FromCryptoPrivateKey(key), privKey, nil
+	}
+}
+
+// Only works for peer IDs derived from the onion key
+func peerIDFromOnion(onionID string) (peer.ID, error) {
+	if pubKey, err := torutil.PublicKeyFromV3OnionServiceID(onionID); err != nil {
+		return "", fmt.Errorf("Invalid onion %v: %v", onionID, err)
+	} else if libp2pPubKey, err := crypto.UnmarshalEd25519PublicKey(pubKey); err != nil {
+		return "", fmt.Errorf("Failed converting onion %v key: %v", onionID, err)
+	} else {
+		return peer.IDFromPublicKey(libp2pPubKey)
+	}
+}
+
+func (impl) IdentityPeerInfo(conf *tordht.DHTConf) (*tordht.PeerInfo, error) {
+	var onionKey ed25519.KeyPair
+	var privKey crypto.PrivKey
+	var err error
+	if conf.OnionIdentity {
+		if conf.OnionKey != nil {
+			return nil, fmt.Errorf("OnionKey cannot be set with OnionIdentity, it is derived from PeerKey")
+		} else if len(conf.PeerKey) == 0 {
+			return nil, fmt.Errorf("PeerKey required")
+		} else if onionKey, privKey, err = onionIdentityFromPeerKey(conf.PeerKey); err != nil {
+			return nil, err
+		}
+	} else if conf.OnionKey == nil || len(conf.PeerKey) == 0 {
+		return nil, fmt.Errorf("OnionKey and PeerKey required")
+	} else if privKey, err = crypto.UnmarshalPrivateKey(conf.PeerKey); err != nil {
+		return nil, fmt.Errorf("Invalid peer key: %v", err)
+	} else {
+		onionKey = conf.OnionKey
+	}
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating peer ID: %v", err)
+	}
+	return &tordht.PeerInfo{
+		Impl:           ipfsImpl.Name(),
+		ImplVersion:    Version,
+		ID:             id.Pretty(),
+		OnionServiceID: torutil.OnionServiceIDFromV3PublicKey(onionKey.PublicKey()),
+	}, nil
+}
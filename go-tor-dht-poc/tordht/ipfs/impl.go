@@ -1,20 +1,29 @@
 package ipfs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/cretz/bine/torutil/ed25519"
 	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
-	cid "github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/sync"
 	log "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
+	pnet "github.com/libp2p/go-libp2p-core/pnet"
+	crypto "github.com/libp2p/go-libp2p-crypto"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	mplex "github.com/libp2p/go-libp2p-mplex"
+	noise "github.com/libp2p/go-libp2p-noise"
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	upgrader "github.com/libp2p/go-libp2p-transport-upgrader"
+	yamux "github.com/libp2p/go-libp2p-yamux"
 	routed "github.com/libp2p/go-libp2p/p2p/host/routed"
-	multihash "github.com/multiformats/go-multihash"
-	mplex "github.com/whyrusleeping/go-smux-multiplex"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 type impl struct{}
@@ -22,15 +31,30 @@ type impl struct{}
 var ipfsImpl = impl{}
 var Impl tordht.Impl = ipfsImpl
 
+func init() { tordht.Register(Impl) }
+
+// Version is the implementation version put in peer infos. Bump the major version when the wire format changes.
+const Version = "1.0.0"
+
 const minPeersRequired = 2
 
+// How many bootstrap peers are dialed at once
+const maxConcurrentPeerConnects = 10
+
+func (impl) Name() string    { return "ipfs" }
+func (impl) Version() string { return Version }
+
+func (impl) Capabilities() tordht.Capabilities {
+	return tordht.Capabilities{I2P: true, SwarmKey: true, PeerCache: true, Browser: true}
+}
+
 func (impl) ApplyDebugLogging() {
 	log.SetDebugLogging()
 	// log.SetAllLoggers(logging.INFO)
 }
 
-func (impl) RawStringDataID(id []byte) (string, error) {
-	if raw, err := ipfsImpl.hashedCID(id); err != nil {
+func (impl) RawStringDataID(id []byte, conf *tordht.DataIDConf) (string, error) {
+	if raw, err := tordht.HashDataID(id, conf); err != nil {
 		return "", err
 	} else {
 		return raw.String(), nil
@@ -38,7 +62,35 @@ func (impl) RawStringDataID(id []byte) (string, error) {
 }
 
 func (impl) NewDHT(ctx context.Context, conf *tordht.DHTConf) (tordht.DHT, error) {
-	t := &torDHT{debug: conf.Verbose, tor: conf.Tor}
+	for _, peer := range conf.BootstrapPeers {
+		if err := peer.CheckImpl(Impl); err != nil {
+			return nil, err
+		}
+	}
+	// Without a security layer, the onion is the only thing tying a conn to a peer ID
+	if conf.Security == tordht.SecurityNone && !conf.OnionIdentity {
+		return nil, fmt.Errorf("No security requires onion identity")
+	}
+	t := &torDHT{
+		debug:           conf.Verbose,
+		dataIDConf:      conf.DataID,
+		onionIdentity:   conf.OnionIdentity,
+		protocolID:      opts.ProtocolDHT,
+		bootstrapPeers:  conf.BootstrapPeers,
+		verifyProviders: conf.VerifyProviders,
+		recentPeers:     map[peer.ID]*recentPeer{},
+	}
+	if conf.Kademlia != nil {
+		// The kad-dht release this is built on has a fixed k and alpha, so they are ignored
+		if conf.Kademlia.BucketSize > 0 || conf.Kademlia.Alpha > 0 {
+			t.debugf("Ignoring bucket size and alpha, always %v and %v", dht.KValue, dht.AlphaValue)
+		}
+		if conf.Kademlia.ProtocolID != "" {
+			t.protocolID = protocol.ID(conf.Kademlia.ProtocolID)
+		}
+		t.replication = conf.Kademlia.Replication
+		t.queryTimeout = conf.Kademlia.QueryTimeout
+	}
 	// Close the dht on any error when creating, so make sure err is populated before returning
 	var err error
 	defer func() {
@@ -47,20 +99,121 @@ func (impl) NewDHT(ctx context.Context, conf *tordht.DHTConf) (tordht.DHT, error
 		}
 	}()
 
-	// Create the host with only the tor transport
+	// Create the host with only the onion and/or I2P transports
 	t.debugf("Creating host")
+	network := conf.Network
+	if network == nil && conf.Tor != nil {
+		network = tordht.NewTorNetwork(conf.Tor, nil)
+	}
+	if network == nil && conf.I2P == nil {
+		err = fmt.Errorf("Network, Tor and/or I2P must be set")
+		return nil, err
+	}
 	transportConf := &TorTransportConf{
-		WebSocket: true,
+		ListenTimeout: conf.ListenTimeout,
+		WebSocket:     true,
+		Verbose:       conf.Verbose,
 	}
-	hostOpts := []libp2p.Option{
-		// libp2p.NoSecurity,
-		libp2p.Muxer("/mplex/6.7.0", mplex.DefaultTransport),
-		libp2p.Transport(NewTorTransport(conf.Tor, transportConf)),
+	switch conf.AddrFormat {
+	case "", tordht.AddrFormatDNS:
+		transportConf.AddrFormat = AddrFormatDNS
+	case tordht.AddrFormatOnion3:
+		transportConf.AddrFormat = AddrFormatProtocol
+	default:
+		err = fmt.Errorf("Unknown addr format: %v", conf.AddrFormat)
+		return nil, err
 	}
-	if !conf.ClientOnly {
-		// Add an address to listen to
-		hostOpts = append(hostOpts, libp2p.ListenAddrs(onionListenAddr))
+	var torAddrFormat addrFormat
+	if torAddrFormat, err = newAddrFormat(transportConf.AddrFormat); err != nil {
+		return nil, err
+	}
+	// We can parse any peer address, but we output per network
+	t.addrFormat = addrFormatComposite{output: torAddrFormat, inputs: []addrFormat{torAddrFormat, addrFormatI2P{}}}
+	var hostOpts []libp2p.Option
+	if hostOpts, err = securityAndMuxerOpts(conf); err != nil {
+		return nil, err
+	}
+	if len(conf.SwarmKey) > 0 {
+		// Connections with a different key fail during the handshake
+		var psk pnet.PSK
+		if psk, err = pnet.DecodeV1PSK(bytes.NewReader(conf.SwarmKey)); err != nil {
+			return nil, fmt.Errorf("Invalid swarm key: %v", err)
+		}
+		hostOpts = append(hostOpts, libp2p.PrivateNetwork(psk))
+	}
+	if conf.OnionIdentity && conf.OnionKey != nil {
+		err = fmt.Errorf("OnionKey cannot be set with OnionIdentity, it is derived from PeerKey")
+		return nil, err
+	}
+	// With onion identity, the identity is added below since it depends on the onion key
+	if len(conf.PeerKey) > 0 && (!conf.OnionIdentity || conf.ClientOnly) {
+		var identity crypto.PrivKey
+		if identity, err = crypto.UnmarshalPrivateKey(conf.PeerKey); err != nil {
+			return nil, fmt.Errorf("Invalid peer key: %v", err)
+		}
+		hostOpts = append(hostOpts, libp2p.Identity(identity))
+	}
+	listenAddrs := []ma.Multiaddr{}
+	if network != nil {
+		if conf.OnionIdentity {
+			transportConf.VerifyOnionPeerID = true
+		}
+		if !conf.ClientOnly {
+			// We make the onion key ourselves so we can sign provider records with it and maybe use it as the
+			// peer identity too
+			if conf.OnionIdentity {
+				var identity crypto.PrivKey
+				if len(conf.PeerKey) > 0 {
+					t.onionKey, identity, err = onionIdentityFromPeerKey(conf.PeerKey)
+				} else {
+					t.onionKey, identity, err = generateOnionIdentity()
+				}
+				if err != nil {
+					return nil, err
+				}
+				hostOpts = append(hostOpts, libp2p.Identity(identity))
+			} else if conf.OnionKey != nil {
+				t.onionKey = conf.OnionKey
+			} else if t.onionKey, err = ed25519.GenerateKey(nil); err != nil {
+				return nil, fmt.Errorf("Failed generating onion key: %v", err)
+			}
+			transportConf.ListenKey = t.onionKey
+		}
+		hostOpts = append(hostOpts, libp2p.Transport(NewTorTransport(network, transportConf)))
+		if !conf.ClientOnly {
+			// Add an address to listen to
+			var listenAddr ma.Multiaddr
+			if listenAddr, err = onionListenAddr(); err != nil {
+				return nil, err
+			}
+			listenAddrs = append(listenAddrs, listenAddr)
+		}
 	}
+	if conf.I2P != nil {
+		i2pTransportConf := &I2PTransportConf{SAMAddr: conf.I2P.SAMAddr, Verbose: conf.Verbose}
+		newI2PTransport := NewI2PTransport(i2pTransportConf)
+		// Wrap so we can close the session ourselves
+		hostOpts = append(hostOpts, libp2p.Transport(func(u *upgrader.Upgrader) (*I2PTransport, error) {
+			i2pTransport, err := newI2PTransport(u)
+			t.i2pTransport = i2pTransport
+			return i2pTransport, err
+		}))
+		if !conf.ClientOnly {
+			var listenAddr ma.Multiaddr
+			if listenAddr, err = i2pListenAddr(); err != nil {
+				return nil, err
+			}
+			listenAddrs = append(listenAddrs, listenAddr)
+		}
+	}
+	if len(listenAddrs) > 0 {
+		hostOpts = append(hostOpts, libp2p.ListenAddrs(listenAddrs...))
+	} else {
+		// Otherwise libp2p listens on TCP on all interfaces
+		hostOpts = append(hostOpts, libp2p.NoListenAddrs)
+	}
+	// Relays would listen on /p2p-circuit and could route us through clearnet peers
+	hostOpts = append(hostOpts, libp2p.DisableRelay())
 	if t.ipfsHost, err = libp2p.New(ctx, hostOpts...); err != nil {
 		return nil, fmt.Errorf("Failed creating host: %v", err)
 	}
@@ -75,7 +228,17 @@ func (impl) NewDHT(ctx context.Context, conf *tordht.DHTConf) (tordht.DHT, error
 	// Create the DHT with a normal datastore
 	t.debugf("Creating DHT on host")
 	ds := sync.MutexWrap(datastore.NewMapDatastore())
-	if t.ipfsDHT, err = dht.New(ctx, t.ipfsHost, opts.Datastore(ds)); err != nil {
+	dhtOpts := []opts.Option{
+		opts.Datastore(ds),
+		opts.NamespacedValidator(providerRecordNamespace, providerRecordValidator{}),
+		opts.Protocols(t.protocolID),
+		// Clients never register the DHT protocol's stream handler. The DHT only adds peers to its routing table once
+		// they have negotiated the DHT protocol with us, so servers never add clients.
+		opts.Client(conf.ClientOnly),
+	}
+	t.limiter = newInboundLimiter(conf.RateLimit)
+	dhtHost := &dhtHost{Host: t.ipfsHost, protocolID: t.protocolID, limiter: t.limiter}
+	if t.ipfsDHT, err = dht.New(ctx, dhtHost, dhtOpts...); err != nil {
 		return nil, fmt.Errorf("Failed creating DHT: %v", err)
 	}
 
@@ -83,25 +246,77 @@ func (impl) NewDHT(ctx context.Context, conf *tordht.DHTConf) (tordht.DHT, error
 	t.debugf("Creating routed host")
 	t.ipfsHost = routed.Wrap(t.ipfsHost, t.ipfsDHT)
 
-	// Connect to at least X (or total count if fewer than X)
-	if len(conf.BootstrapPeers) > 0 {
-		if err = t.connectPeers(ctx, conf.BootstrapPeers, minPeersRequired); err != nil {
-			return nil, fmt.Errorf("Failed connecting to peers: %v", err)
+	// Connect to at least X (or total given count if fewer than X), preferring the given peers over the cached ones
+	bootstrapPeers, requiredPeers := conf.BootstrapPeers, minPeersRequired
+	if len(conf.BootstrapPeers) == 0 {
+		requiredPeers = 1
+	} else if len(conf.BootstrapPeers) < requiredPeers {
+		requiredPeers = len(conf.BootstrapPeers)
+	}
+	if conf.PeerCacheFile != "" {
+		if t.peerCache, err = loadPeerCache(conf.PeerCacheFile); err != nil {
+			return nil, err
 		}
+		bootstrapPeers = appendUniquePeers(bootstrapPeers, t.peerCache.candidates())
 	}
-
-	// Bootstrap the DHT
-	t.debugf("Bootstrapping DHT")
-	if err = t.ipfsDHT.Bootstrap(ctx); err != nil {
-		return nil, fmt.Errorf("Failed boostrapping DHT: %v", err)
+	if len(bootstrapPeers) > 0 {
+		err = t.connectPeers(ctx, bootstrapPeers, requiredPeers)
 	}
+	// Cached peers are only candidates, so without given peers, reaching none of them is like being the first node
+	if err != nil && len(conf.BootstrapPeers) == 0 && ctx.Err() == nil {
+		t.debugf("Starting without peers, no cached peer was reachable: %v", err)
+		err = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed connecting to peers: %v", err)
+	} else if len(bootstrapPeers) > 0 {
+		// Bootstrap the DHT once, then the maintenance loop refreshes it and reconnects as needed. The first node of a
+		// network has nobody to bootstrap from, the DHT fails on an empty routing table.
+		t.debugf("Bootstrapping DHT")
+		bootstrapConf := dht.DefaultBootstrapConfig
+		if t.queryTimeout > 0 {
+			bootstrapConf.Timeout = t.queryTimeout
+		}
+		if err = t.ipfsDHT.BootstrapOnce(ctx, bootstrapConf); err != nil {
+			return nil, fmt.Errorf("Failed boostrapping DHT: %v", err)
+		}
+		t.status.LastRefresh = time.Now()
+	}
+	t.startMaintenance(conf.Maintenance)
 	return t, nil
 }
 
-func (impl) hashedCID(v []byte) (*cid.Cid, error) {
-	if hash, err := multihash.Sum(v, multihash.SHA3_256, -1); err != nil {
-		return nil, fmt.Errorf("Failed hashing ID: %v", err)
-	} else {
-		return cid.NewCidV1(0, hash), nil
+func securityAndMuxerOpts(conf *tordht.DHTConf) ([]libp2p.Option, error) {
+	ret := []libp2p.Option{}
+	switch conf.Security {
+	case "", tordht.SecurityDefault:
+		// Leave as libp2p default
+	case tordht.SecurityNoise:
+		ret = append(ret, libp2p.Security(noise.ID, noise.New))
+	case tordht.SecurityNone:
+		// NewDHT already confirmed onion identity
+		ret = append(ret, libp2p.NoSecurity)
+	default:
+		return nil, fmt.Errorf("Unknown security: %v", conf.Security)
+	}
+	switch conf.Muxer {
+	case "", tordht.MuxerMplex:
+		ret = append(ret, libp2p.Muxer("/mplex/6.7.0", mplex.DefaultTransport))
+	case tordht.MuxerYamux:
+		ret = append(ret, libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport))
+	default:
+		return nil, fmt.Errorf("Unknown muxer: %v", conf.Muxer)
+	}
+	return ret, nil
+}
+
+func appendUniquePeers(peers []*tordht.PeerInfo, toAdd []*tordht.PeerInfo) []*tordht.PeerInfo {
+	ret := make([]*tordht.PeerInfo, 0, len(peers)+len(toAdd))
+	seen := map[string]bool{}
+	for _, peer := range append(append([]*tordht.PeerInfo{}, peers...), toAdd...) {
+		if !seen[peer.ID] {
+			seen[peer.ID] = true
+			ret = append(ret, peer)
+		}
 	}
+	return ret
 }
@@ -0,0 +1,147 @@
+package ipfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/tordhttest"
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestConformance(t *testing.T) { tordhttest.Run(t, Impl) }
+
+func TestStaleCachedPeersAreOptional(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), tordhttest.TestTimeout)
+	defer cancelFn()
+	dir, err := ioutil.TempDir("", "tordht-peer-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Cache a node that is then gone
+	c := tordhttest.NewCluster(ctx, t, Impl, 1)
+	defer c.Close()
+	cache := &peerCache{path: filepath.Join(dir, "peers.json"), entries: map[string]*peerCacheEntry{}}
+	cache.record(c.Nodes[0].PeerInfo(), true)
+	if err = cache.save(); err != nil {
+		t.Fatal(err)
+	} else if err = c.Nodes[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Without given peers, it starts like the first node
+	conf := &tordht.DHTConf{Network: c.Network, PeerCacheFile: cache.path}
+	node, err := Impl.NewDHT(ctx, conf)
+	if err != nil {
+		t.Fatalf("Expected start with only stale cached peers to succeed, got: %v", err)
+	}
+	node.Close()
+	// With given peers that can't be reached, it still fails
+	conf.BootstrapPeers = []*tordht.PeerInfo{c.Nodes[0].PeerInfo()}
+	if node, err = Impl.NewDHT(ctx, conf); err == nil {
+		node.Close()
+		t.Fatalf("Expected unreachable given peer to fail")
+	}
+}
+
+func TestSecurityNoneRequiresOnionIdentity(t *testing.T) {
+	conf := &tordht.DHTConf{Security: tordht.SecurityNone}
+	if dht, err := Impl.NewDHT(context.Background(), conf); err == nil {
+		dht.Close()
+		t.Fatal("Expected failure without onion identity")
+	} else if !strings.Contains(err.Error(), "onion identity") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func BenchmarkHandshakeSecioMplex(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityDefault, tordht.MuxerMplex)
+}
+
+func BenchmarkHandshakeSecioYamux(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityDefault, tordht.MuxerYamux)
+}
+
+func BenchmarkHandshakeNoiseMplex(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityNoise, tordht.MuxerMplex)
+}
+
+func BenchmarkHandshakeNoiseYamux(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityNoise, tordht.MuxerYamux)
+}
+
+func BenchmarkHandshakeNoneMplex(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityNone, tordht.MuxerMplex)
+}
+
+func BenchmarkHandshakeNoneYamux(b *testing.B) {
+	benchmarkHandshake(b, tordht.SecurityNone, tordht.MuxerYamux)
+}
+
+// Times a new connection from one host to another over loopback TCP, i.e. the dial plus the security and muxer
+// negotiation. The Tor circuit setup that dominates in practice is not included.
+func benchmarkHandshake(b *testing.B, security tordht.Security, muxer tordht.Muxer) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	newHost := func() host.Host {
+		hostOpts, err := securityAndMuxerOpts(&tordht.DHTConf{Security: security, Muxer: muxer})
+		if err != nil {
+			b.Fatal(err)
+		}
+		hostOpts = append(hostOpts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		h, err := libp2p.New(ctx, hostOpts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return h
+	}
+	server := newHost()
+	defer server.Close()
+	client := newHost()
+	defer client.Close()
+	serverInfo := peerstore.PeerInfo{ID: server.ID(), Addrs: server.Addrs()}
+	// Otherwise the addresses can be dropped when the conn is closed
+	client.Peerstore().AddAddrs(serverInfo.ID, serverInfo.Addrs, peerstore.PermanentAddrTTL)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := client.Network().ClosePeer(serverInfo.ID); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := client.Connect(ctx, serverInfo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAddrFormatConf(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), tordhttest.TestTimeout)
+	defer cancelFn()
+	network := tordhttest.NewMemoryNetwork()
+	for format, prefix := range map[tordht.AddrFormat]string{
+		"":                      "/dns4/",
+		tordht.AddrFormatDNS:    "/dns4/",
+		tordht.AddrFormatOnion3: "/onion3/",
+	} {
+		dht, err := Impl.NewDHT(ctx, &tordht.DHTConf{Network: network, AddrFormat: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := dht.(*torDHT).ipfsHost.Addrs()
+		dht.Close()
+		if len(addrs) != 1 || !strings.HasPrefix(addrs[0].String(), prefix) {
+			t.Fatalf("Expected format '%v' to have one %v address, got %v", format, prefix, addrs)
+		}
+	}
+	if dht, err := Impl.NewDHT(ctx, &tordht.DHTConf{Network: network, AddrFormat: "bad"}); err == nil {
+		dht.Close()
+		t.Fatal("Expected unknown addr format to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package ipfs
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Dials each provider with bounded concurrency and returns only the reachable ones, fastest first
+func (t *torDHT) liveProviders(ctx context.Context, providers []*tordht.PeerInfo) []*tordht.PeerInfo {
+	concurrency, timeout := 3, 1*time.Minute
+	if t.verifyProviders.Concurrency > 0 {
+		concurrency = t.verifyProviders.Concurrency
+	}
+	if t.verifyProviders.Timeout > 0 {
+		timeout = t.verifyProviders.Timeout
+	}
+	t.debugf("Verifying %v providers are reachable", len(providers))
+	sem := make(chan struct{}, concurrency)
+	resultCh := make(chan *tordht.PeerInfo, len(providers))
+	for _, provider := range providers {
+		go func(provider *tordht.PeerInfo) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				resultCh <- nil
+				return
+			}
+			if latency, err := t.measureConnect(ctx, provider, timeout); err != nil {
+				t.debugf("Provider %v unreachable: %v", provider, err)
+				resultCh <- nil
+			} else {
+				verified := *provider
+				verified.ConnectLatency = latency
+				resultCh <- &verified
+			}
+		}(provider)
+	}
+	ret := []*tordht.PeerInfo{}
+	for range providers {
+		if provider := <-resultCh; provider != nil {
+			ret = append(ret, provider)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return fasterProvider(ret[i], ret[j]) })
+	return ret
+}
+
+// Whether a has a lower latency than b, unmeasured last
+func fasterProvider(a *tordht.PeerInfo, b *tordht.PeerInfo) bool {
+	if a.ConnectLatency == tordht.LatencyUnmeasured || b.ConnectLatency == tordht.LatencyUnmeasured {
+		return b.ConnectLatency == tordht.LatencyUnmeasured && a.ConnectLatency != tordht.LatencyUnmeasured
+	}
+	return a.ConnectLatency < b.ConnectLatency
+}
+
+func (t *torDHT) measureConnect(ctx context.Context, provider *tordht.PeerInfo, timeout time.Duration) (
+	time.Duration, error) {
+	id, err := peer.IDB58Decode(provider.ID)
+	if err != nil {
+		return 0, err
+	} else if id == t.ipfsHost.ID() {
+		return tordht.LatencyUnmeasured, nil
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+	start := time.Now()
+	// If already connected, the round trip of a ping over the conn is the best we can do
+	if len(t.ipfsHost.Network().ConnsToPeer(id)) > 0 {
+		err = t.ipfsDHT.Ping(ctx, id)
+	} else {
+		err = t.connectPeer(ctx, provider)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
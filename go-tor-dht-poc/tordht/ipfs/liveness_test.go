@@ -0,0 +1,20 @@
+package ipfs
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+func TestFasterProvider(t *testing.T) {
+	providers := []*tordht.PeerInfo{
+		{ID: "self", ConnectLatency: tordht.LatencyUnmeasured},
+		{ID: "slow", ConnectLatency: 300},
+		{ID: "fast", ConnectLatency: 100},
+	}
+	sort.SliceStable(providers, func(i, j int) bool { return fasterProvider(providers[i], providers[j]) })
+	if providers[0].ID != "fast" || providers[1].ID != "slow" || providers[2].ID != "self" {
+		t.Fatalf("Expected fast, slow, then self, got %v, %v, %v", providers[0].ID, providers[1].ID, providers[2].ID)
+	}
+}
@@ -0,0 +1,203 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// How many recently seen peers are kept as reconnect candidates, the least recently seen is dropped for new ones
+const maxRecentPeers = 50
+
+type recentPeer struct {
+	info     *tordht.PeerInfo
+	lastSeen time.Time
+}
+
+func (t *torDHT) Status() *tordht.Status {
+	t.statusLock.Lock()
+	ret := t.status
+	t.statusLock.Unlock()
+	ret.RoutingTableSize = t.ipfsDHT.RoutingTable().Size()
+	ret.ConnectedPeers = len(t.ipfsHost.Network().Peers())
+	if t.limiter != nil {
+		t.limiter.applyStatus(&ret)
+	}
+	return &ret
+}
+
+func (t *torDHT) Peers() []*tordht.PeerInfo {
+	ret := []*tordht.PeerInfo{}
+	for _, p := range t.ipfsDHT.RoutingTable().ListPeers() {
+		if info, err := t.makePeerInfoFromAddrs(p, t.ipfsHost.Peerstore().Addrs(p)); err == nil {
+			ret = append(ret, info)
+		}
+	}
+	return ret
+}
+
+func (t *torDHT) startMaintenance(conf *tordht.MaintenanceConf) {
+	minSize, checkInterval, refreshInterval := minPeersRequired, 30*time.Second, 5*time.Minute
+	if conf != nil {
+		if conf.MinRoutingTableSize > 0 {
+			minSize = conf.MinRoutingTableSize
+		}
+		if conf.CheckInterval > 0 {
+			checkInterval = conf.CheckInterval
+		}
+		if conf.RefreshInterval > 0 {
+			refreshInterval = conf.RefreshInterval
+		}
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.maintenanceCancel = cancelFn
+	t.maintenanceDone = make(chan struct{})
+	go func() {
+		defer close(t.maintenanceDone)
+		checkTicker, refreshTicker := time.NewTicker(checkInterval), time.NewTicker(refreshInterval)
+		defer checkTicker.Stop()
+		defer refreshTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-checkTicker.C:
+				t.checkRoutingTable(ctx, minSize)
+			case <-refreshTicker.C:
+				t.refresh(ctx)
+			}
+		}
+	}()
+}
+
+func (t *torDHT) stopMaintenance() {
+	if t.maintenanceCancel != nil {
+		t.maintenanceCancel()
+		<-t.maintenanceDone
+		t.maintenanceCancel = nil
+	}
+}
+
+// Remembers the current peers while healthy, re-dials them and the bootstrap peers when not
+func (t *torDHT) checkRoutingTable(ctx context.Context, minSize int) {
+	routingPeers := t.ipfsDHT.RoutingTable().ListPeers()
+	if len(routingPeers) >= minSize {
+		t.rememberPeers(routingPeers)
+		return
+	}
+	t.debugf("Routing table has %v peers, less than %v, reconnecting", len(routingPeers), minSize)
+	candidates := t.reconnectCandidates()
+	if len(candidates) == 0 {
+		t.setStatusErr(fmt.Errorf("No peers to reconnect to"), false)
+		return
+	}
+	err := t.connectPeers(ctx, candidates, minSize)
+	t.statusLock.Lock()
+	t.status.LastReconnect = time.Now()
+	t.status.Reconnects++
+	t.statusLock.Unlock()
+	if err != nil {
+		t.setStatusErr(fmt.Errorf("Failed reconnecting: %v", err), false)
+		return
+	}
+	t.refresh(ctx)
+}
+
+func (t *torDHT) refresh(ctx context.Context) {
+	t.debugf("Refreshing routing table")
+	bootstrapConf := dht.DefaultBootstrapConfig
+	if t.queryTimeout > 0 {
+		bootstrapConf.Timeout = t.queryTimeout
+	}
+	err := t.ipfsDHT.BootstrapOnce(ctx, bootstrapConf)
+	if err != nil {
+		err = fmt.Errorf("Failed refreshing: %v", err)
+	}
+	t.setStatusErr(err, true)
+}
+
+func (t *torDHT) setStatusErr(err error, refreshed bool) {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if refreshed {
+		t.status.LastRefresh = time.Now()
+	}
+	if err == nil {
+		t.status.LastError = ""
+	} else {
+		t.debugf("Maintenance error: %v", err)
+		t.status.LastError = err.Error()
+	}
+}
+
+func (t *torDHT) rememberPeers(peers []peer.ID) {
+	t.statusLock.Lock()
+	for _, p := range peers {
+		if info, err := t.makePeerInfoFromAddrs(p, t.ipfsHost.Peerstore().Addrs(p)); err == nil {
+			t.recentPeers[p] = &recentPeer{info: info, lastSeen: time.Now()}
+			if t.peerCache != nil {
+				t.peerCache.seen(info)
+			}
+		}
+	}
+	t.evictRecentPeers()
+	t.statusLock.Unlock()
+	if t.peerCache != nil {
+		if err := t.peerCache.save(); err != nil {
+			t.debugf("Failed saving peer cache: %v", err)
+		}
+	}
+}
+
+// Expects statusLock to be held
+func (t *torDHT) evictRecentPeers() {
+	for len(t.recentPeers) > maxRecentPeers {
+		var oldest peer.ID
+		for p, recent := range t.recentPeers {
+			if oldest == "" || recent.lastSeen.Before(t.recentPeers[oldest].lastSeen) {
+				oldest = p
+			}
+		}
+		delete(t.recentPeers, oldest)
+	}
+}
+
+// Bootstrap peers and recently seen peers we are not connected to
+func (t *torDHT) reconnectCandidates() []*tordht.PeerInfo {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	seen := map[string]bool{}
+	ret := []*tordht.PeerInfo{}
+	add := func(info *tordht.PeerInfo) {
+		if seen[info.ID] {
+			return
+		}
+		seen[info.ID] = true
+		if id, err := peer.IDB58Decode(info.ID); err != nil || len(t.ipfsHost.Network().ConnsToPeer(id)) == 0 {
+			ret = append(ret, info)
+		}
+	}
+	for _, info := range t.bootstrapPeers {
+		add(info)
+	}
+	// Most recently seen first
+	recent := make([]*recentPeer, 0, len(t.recentPeers))
+	for _, r := range t.recentPeers {
+		recent = append(recent, r)
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i].lastSeen.After(recent[j].lastSeen) })
+	for _, r := range recent {
+		add(r.info)
+	}
+	if t.peerCache != nil {
+		for _, info := range t.peerCache.candidates() {
+			add(info)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,29 @@
+package ipfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestEvictRecentPeers(t *testing.T) {
+	d := &torDHT{recentPeers: map[peer.ID]*recentPeer{}}
+	start := time.Now()
+	for i := 0; i < maxRecentPeers+10; i++ {
+		id := peer.ID(fmt.Sprintf("peer%v", i))
+		d.recentPeers[id] = &recentPeer{info: &tordht.PeerInfo{ID: string(id)}, lastSeen: start.Add(time.Duration(i))}
+		d.evictRecentPeers()
+	}
+	if len(d.recentPeers) != maxRecentPeers {
+		t.Fatalf("Expected %v recent peers, got %v", maxRecentPeers, len(d.recentPeers))
+	}
+	// The oldest ones are gone
+	for i := 0; i < maxRecentPeers+10; i++ {
+		if _, ok := d.recentPeers[peer.ID(fmt.Sprintf("peer%v", i))]; ok != (i >= 10) {
+			t.Fatalf("Expected peer%v kept to be %v", i, i >= 10)
+		}
+	}
+}
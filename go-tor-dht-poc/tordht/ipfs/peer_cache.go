@@ -0,0 +1,161 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// Entries not seen in this long are dropped
+const peerCacheMaxAge = 7 * 24 * time.Hour
+
+// Only the best entries are kept
+const peerCacheMaxEntries = 100
+
+// Good peers saved across runs to be used as bootstrap candidates
+type peerCache struct {
+	path string
+
+	lock    sync.Mutex
+	entries map[string]*peerCacheEntry
+}
+
+type peerCacheEntry struct {
+	// The PeerInfo string
+	Peer      string
+	LastSeen  time.Time
+	Successes int
+	Failures  int
+}
+
+func (p *peerCacheEntry) successRate() float64 {
+	if total := p.Successes + p.Failures; total > 0 {
+		return float64(p.Successes) / float64(total)
+	}
+	return 0
+}
+
+// A missing file is an empty cache
+func loadPeerCache(path string) (*peerCache, error) {
+	ret := &peerCache{path: path, entries: map[string]*peerCacheEntry{}}
+	byts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed reading peer cache: %v", err)
+	}
+	entries := []*peerCacheEntry{}
+	if err = json.Unmarshal(byts, &entries); err != nil {
+		return nil, fmt.Errorf("Invalid peer cache %v: %v", path, err)
+	}
+	for _, entry := range entries {
+		if info, err := tordht.NewPeerInfo(entry.Peer); err == nil {
+			ret.entries[info.ID] = entry
+		}
+	}
+	ret.ageOut()
+	return ret, nil
+}
+
+// Best first, by success rate then last seen
+func (p *peerCache) candidates() []*tordht.PeerInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entries := p.sortedEntries()
+	ret := make([]*tordht.PeerInfo, 0, len(entries))
+	for _, entry := range entries {
+		if info, err := tordht.NewPeerInfo(entry.Peer); err == nil {
+			ret = append(ret, info)
+		}
+	}
+	return ret
+}
+
+// Records a connection attempt
+func (p *peerCache) record(info *tordht.PeerInfo, success bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := p.entry(info)
+	if success {
+		entry.Successes++
+		entry.LastSeen = time.Now()
+	} else {
+		entry.Failures++
+	}
+}
+
+// Records that the peer is in the routing table
+func (p *peerCache) seen(info *tordht.PeerInfo) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.entry(info).LastSeen = time.Now()
+}
+
+func (p *peerCache) save() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ageOut()
+	byts, err := json.MarshalIndent(p.sortedEntries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to temp and rename so a crash doesn't leave a partial file
+	if err = os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(p.path+".tmp", byts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p.path+".tmp", p.path)
+}
+
+// Expects lock to be held
+func (p *peerCache) entry(info *tordht.PeerInfo) *peerCacheEntry {
+	entry := p.entries[info.ID]
+	if entry == nil {
+		entry = &peerCacheEntry{}
+		p.entries[info.ID] = entry
+	}
+	// Addresses may change
+	entry.Peer = info.String()
+	return entry
+}
+
+// Expects lock to be held
+func (p *peerCache) sortedEntries() []*peerCacheEntry {
+	ret := make([]*peerCacheEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		ret = append(ret, entry)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if iRate, jRate := ret[i].successRate(), ret[j].successRate(); iRate != jRate {
+			return iRate > jRate
+		}
+		return ret[i].LastSeen.After(ret[j].LastSeen)
+	})
+	return ret
+}
+
+// Expects lock to be held
+func (p *peerCache) ageOut() {
+	for id, entry := range p.entries {
+		// Never seen entries only go if they have failed
+		if (entry.LastSeen.IsZero() && entry.Failures > 0) ||
+			(!entry.LastSeen.IsZero() && time.Since(entry.LastSeen) > peerCacheMaxAge) {
+			delete(p.entries, id)
+		}
+	}
+	if len(p.entries) > peerCacheMaxEntries {
+		for _, entry := range p.sortedEntries()[peerCacheMaxEntries:] {
+			if info, err := tordht.NewPeerInfo(entry.Peer); err == nil {
+				delete(p.entries, info.ID)
+			}
+		}
+	}
+}
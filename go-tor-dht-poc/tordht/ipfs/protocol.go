@@ -1,44 +1,85 @@
 package ipfs
 
 import (
-	"encoding/base32"
 	"fmt"
+	"sync"
 
 	ma "github.com/multiformats/go-multiaddr"
 )
 
-var serviceIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
-var onionListenAddr ma.Multiaddr
-
-const ONION_LISTEN_PROTO_CODE = 0x55
+// ONION_LISTEN_PROTO_CODE is the multiaddr code for "/onionListen", the address given to the host to have the Tor
+// transport create an onion service. It is in the multicodec private-use range so it can never collide with a
+// protocol registered by someone else.
+const ONION_LISTEN_PROTO_CODE = 0x300055
 
 var onionListenProto = ma.Protocol{
-	"onionListen", ONION_LISTEN_PROTO_CODE, ma.CodeToVarint(ONION_LISTEN_PROTO_CODE), 0, false, nil}
-
-func init() {
-	// Add the listen protocol
-	if err := ma.AddProtocol(onionListenProto); err != nil {
-		panic(fmt.Errorf("Failed adding onionListen protocol: %v", err))
-	} else if onionListenAddr, err = ma.NewMultiaddr("/onionListen"); err != nil {
-		panic(fmt.Errorf("Failed creating onionListen addr: %v", err))
-	}
-	// Change existing onion protocol to support v3 and be more lenient when transcoding
-	ma.TranscoderOnion = ma.NewTranscoderFromFunctions(onionStringToBytes, onionBytesToString, nil)
-	for _, p := range ma.Protocols {
-		if p.Code == ma.P_ONION {
-			p.Size = ma.LengthPrefixedVarSize
-			p.Transcoder = ma.TranscoderOnion
-			break
+	Name: "onionListen", Code: ONION_LISTEN_PROTO_CODE, VCode: ma.CodeToVarint(ONION_LISTEN_PROTO_CODE)}
+
+// I2P_LISTEN_PROTO_CODE is the multiaddr code for "/i2pListen", the address given to the host to have the I2P
+// transport listen on its session destination. Also in the private-use range.
+const I2P_LISTEN_PROTO_CODE = 0x300056
+
+var i2pListenProto = ma.Protocol{
+	Name: "i2pListen", Code: I2P_LISTEN_PROTO_CODE, VCode: ma.CodeToVarint(I2P_LISTEN_PROTO_CODE)}
+
+// I2P_PROTO_CODE is the multiaddr code for "/i2p/<b32-addr>" addresses. Also in the private-use range.
+const I2P_PROTO_CODE = 0x300057
+
+var i2pProto = ma.Protocol{
+	Name:       "i2p",
+	Code:       I2P_PROTO_CODE,
+	VCode:      ma.CodeToVarint(I2P_PROTO_CODE),
+	Size:       ma.LengthPrefixedVarSize,
+	Transcoder: ma.NewTranscoderFromFunctions(stringToBytes, bytesToString, nil),
+}
+
+var registerProtocolsOnce sync.Once
+var registerProtocolsErr error
+
+// registerProtocols lazily registers all of our protocols at once, so a Tor-only node can still parse "/i2p" addresses
+// it hears about. Nothing else in the multiaddr protocol table is touched.
+func registerProtocols() error {
+	registerProtocolsOnce.Do(func() {
+		for _, proto := range []ma.Protocol{onionListenProto, i2pListenProto, i2pProto} {
+			if registerProtocolsErr = registerProtocol(proto); registerProtocolsErr != nil {
+				return
+			}
 		}
+	})
+	return registerProtocolsErr
+}
+
+// onionListenAddr registers the protocols and returns the "/onionListen" address
+func onionListenAddr() (ma.Multiaddr, error) {
+	if err := registerProtocols(); err != nil {
+		return nil, err
 	}
+	return ma.NewMultiaddr("/" + onionListenProto.Name)
 }
 
-func onionStringToBytes(str string) ([]byte, error) {
-	// Just convert the whole thing for now
-	return []byte(str), nil
+// i2pListenAddr registers the protocols and returns the "/i2pListen" address
+func i2pListenAddr() (ma.Multiaddr, error) {
+	if err := registerProtocols(); err != nil {
+		return nil, err
+	}
+	return ma.NewMultiaddr("/" + i2pListenProto.Name)
 }
 
-func onionBytesToString(byts []byte) (string, error) {
-	// Just convert the whole thing for now
-	return string(byts), nil
+// registerProtocol adds the protocol unless the exact same one is already there. If the name or code is taken by a
+// different protocol, an error is returned instead of replacing it.
+func registerProtocol(proto ma.Protocol) error {
+	byName, byCode := ma.ProtocolWithName(proto.Name), ma.ProtocolWithCode(proto.Code)
+	if byName.Code == 0 && byCode.Code == 0 {
+		if err := ma.AddProtocol(proto); err != nil {
+			return fmt.Errorf("Failed adding %v protocol: %v", proto.Name, err)
+		}
+		return nil
+	} else if byName.Code != proto.Code || byCode.Name != proto.Name || byCode.Size != proto.Size {
+		return fmt.Errorf("Protocol %v (code %v) conflicts with existing protocol %v (code %v)",
+			proto.Name, proto.Code, byCode.Name, byCode.Code)
+	}
+	return nil
 }
+
+func stringToBytes(str string) ([]byte, error)  { return []byte(str), nil }
+func bytesToString(byts []byte) (string, error) { return string(byts), nil }
@@ -0,0 +1,142 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const providerRecordNamespace = "tordhtprov"
+
+// Stored as a DHT value next to the normal provider record. It is signed by the onion service key so only the
+// holder of the onion can claim a peer ID provides a CID at that onion, and by the peer key so only the holder of the
+// peer ID can claim it is at that onion.
+type providerRecord struct {
+	CID            string
+	PeerID         string
+	OnionServiceID string
+	OnionPort      int
+	// Up to tordht.MaxProviderMetadataSize bytes, may be empty
+	Metadata []byte
+	// Unix seconds, the newest record is selected
+	Created int64
+	// By the onion service key
+	Signature []byte
+	// The libp2p marshaled public key of the peer ID, not all peer IDs embed it
+	PeerPublicKey []byte
+	// By the peer key, over the same bytes
+	PeerSignature []byte
+}
+
+// In the form /tordhtprov/<cid>/<peer-id>
+func providerRecordKey(c cid.Cid, id peer.ID) string {
+	return "/" + providerRecordNamespace + "/" + c.String() + "/" + id.Pretty()
+}
+
+func newProviderRecord(c cid.Cid, info *tordht.PeerInfo, metadata []byte, key ed25519.KeyPair,
+	peerKey crypto.PrivKey) (*providerRecord, error) {
+	if info.IsI2P() {
+		return nil, fmt.Errorf("Provider records can only be signed for onion services")
+	}
+	ret := &providerRecord{
+		CID:            c.String(),
+		PeerID:         info.ID,
+		OnionServiceID: info.OnionServiceID,
+		OnionPort:      info.OnionPort,
+		Metadata:       metadata,
+		Created:        time.Now().Unix(),
+	}
+	// Make sure the key is for the onion
+	if torutil.OnionServiceIDFromV3PublicKey(key.PublicKey()) != info.OnionServiceID {
+		return nil, fmt.Errorf("Key is not for onion %v", info.OnionServiceID)
+	}
+	ret.Signature = ed25519.Sign(key, ret.signedBytes())
+	// And the peer key for the peer ID
+	if id, err := peer.IDFromPrivateKey(peerKey); err != nil || id.Pretty() != info.ID {
+		return nil, fmt.Errorf("Peer key is not for peer %v", info.ID)
+	} else if ret.PeerPublicKey, err = crypto.MarshalPublicKey(peerKey.GetPublic()); err != nil {
+		return nil, fmt.Errorf("Failed marshaling peer key: %v", err)
+	} else if ret.PeerSignature, err = peerKey.Sign(ret.signedBytes()); err != nil {
+		return nil, fmt.Errorf("Failed signing with peer key: %v", err)
+	}
+	return ret, nil
+}
+
+func (p *providerRecord) signedBytes() []byte {
+	return []byte(fmt.Sprintf("tordht-provider-record\n%v\n%v\n%v:%v\n%v\n%x",
+		p.CID, p.PeerID, p.OnionServiceID, p.OnionPort, p.Created, p.Metadata))
+}
+
+// Confirms the signatures are from the onion service's key and the peer ID's key. Without the latter, anyone could
+// put a record binding their onion to someone else's peer ID.
+func (p *providerRecord) verify() error {
+	if len(p.Metadata) > tordht.MaxProviderMetadataSize {
+		return fmt.Errorf("Metadata is %v bytes, max is %v", len(p.Metadata), tordht.MaxProviderMetadataSize)
+	} else if pubKey, err := torutil.PublicKeyFromV3OnionServiceID(p.OnionServiceID); err != nil {
+		return fmt.Errorf("Invalid onion %v: %v", p.OnionServiceID, err)
+	} else if !ed25519.Verify(pubKey, p.signedBytes(), p.Signature) {
+		return fmt.Errorf("Invalid signature for onion %v", p.OnionServiceID)
+	} else if peerPubKey, err := crypto.UnmarshalPublicKey(p.PeerPublicKey); err != nil {
+		return fmt.Errorf("Invalid peer key: %v", err)
+	} else if id, err := peer.IDFromPublicKey(peerPubKey); err != nil || id.Pretty() != p.PeerID {
+		return fmt.Errorf("Peer key is not for peer %v", p.PeerID)
+	} else if ok, err := peerPubKey.Verify(p.signedBytes(), p.PeerSignature); err != nil || !ok {
+		return fmt.Errorf("Invalid signature for peer %v", p.PeerID)
+	}
+	return nil
+}
+
+func (p *providerRecord) peerInfo() *tordht.PeerInfo {
+	return &tordht.PeerInfo{
+		ID:             p.PeerID,
+		OnionServiceID: p.OnionServiceID,
+		OnionPort:      p.OnionPort,
+		Metadata:       p.Metadata,
+	}
+}
+
+func unmarshalProviderRecord(byts []byte) (*providerRecord, error) {
+	ret := &providerRecord{}
+	if err := json.Unmarshal(byts, ret); err != nil {
+		return nil, fmt.Errorf("Invalid provider record: %v", err)
+	}
+	return ret, nil
+}
+
+// impls libp2p's record.Validator
+type providerRecordValidator struct{}
+
+func (providerRecordValidator) Validate(key string, value []byte) error {
+	pieces := strings.Split(key, "/")
+	if len(pieces) != 4 || pieces[0] != "" || pieces[1] != providerRecordNamespace {
+		return fmt.Errorf("Invalid provider record key: %v", key)
+	}
+	rec, err := unmarshalProviderRecord(value)
+	if err != nil {
+		return err
+	} else if rec.CID != pieces[2] || rec.PeerID != pieces[3] {
+		return fmt.Errorf("Provider record does not match key %v", key)
+	}
+	return rec.verify()
+}
+
+func (providerRecordValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestCreated := -1, int64(0)
+	for i, value := range values {
+		if rec, err := unmarshalProviderRecord(value); err == nil && (best == -1 || rec.Created > bestCreated) {
+			best, bestCreated = i, rec.Created
+		}
+	}
+	if best == -1 {
+		return 0, fmt.Errorf("No valid provider records")
+	}
+	return best, nil
+}
@@ -0,0 +1,100 @@
+package ipfs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+type testProvider struct {
+	onionKey ed25519.KeyPair
+	peerKey  crypto.PrivKey
+	info     *tordht.PeerInfo
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	onionKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testProvider{onionKey: onionKey, peerKey: peerKey, info: &tordht.PeerInfo{
+		ID:             id.Pretty(),
+		OnionServiceID: torutil.OnionServiceIDFromV3PublicKey(onionKey.PublicKey()),
+		OnionPort:      80,
+	}}
+}
+
+func TestProviderRecordValidate(t *testing.T) {
+	c, err := tordht.HashDataID([]byte("tordhttest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, attacker := newTestProvider(t), newTestProvider(t)
+	validate := func(rec *providerRecord) error {
+		byts, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keyed by the record's own CID and peer ID so only the signatures can fail
+		recCID, _ := cid.Decode(rec.CID)
+		id, _ := peer.IDB58Decode(rec.PeerID)
+		return providerRecordValidator{}.Validate(providerRecordKey(recCID, id), byts)
+	}
+	rec, err := newProviderRecord(c, victim.info, []byte("meta"), victim.onionKey, victim.peerKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = validate(rec); err != nil {
+		t.Fatalf("Expected valid record, got: %v", err)
+	}
+	// Can't create one for someone else's peer ID
+	forged := *victim.info
+	forged.OnionServiceID = attacker.info.OnionServiceID
+	if _, err = newProviderRecord(c, &forged, nil, attacker.onionKey, attacker.peerKey); err == nil {
+		t.Fatal("Expected failure signing for another peer ID")
+	}
+	// Nor put one by hand with the attacker's onion signature and peer key
+	rec, err = newProviderRecord(c, attacker.info, nil, attacker.onionKey, attacker.peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.PeerID = victim.info.ID
+	rec.Signature = ed25519.Sign(attacker.onionKey, rec.signedBytes())
+	if err = validate(rec); err == nil {
+		t.Fatal("Expected failure for attacker's peer key")
+	}
+	// Nor with the victim's public key but no valid signature from it
+	if rec.PeerPublicKey, err = crypto.MarshalPublicKey(victim.peerKey.GetPublic()); err != nil {
+		t.Fatal(err)
+	} else if err = validate(rec); err == nil {
+		t.Fatal("Expected failure for attacker's peer signature")
+	}
+	// Nor without peer signature at all
+	rec.PeerPublicKey, rec.PeerSignature = nil, nil
+	if err = validate(rec); err == nil {
+		t.Fatal("Expected failure for missing peer signature")
+	}
+	// And a valid record can't be moved to another CID
+	other, _ := tordht.HashDataID([]byte("other"), nil)
+	if rec, err = newProviderRecord(c, victim.info, nil, victim.onionKey, victim.peerKey); err != nil {
+		t.Fatal(err)
+	}
+	rec.CID = other.String()
+	if err = validate(rec); err == nil {
+		t.Fatal("Expected failure for changed CID")
+	}
+}
@@ -0,0 +1,200 @@
+package ipfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	proto "github.com/gogo/protobuf/proto"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	providers "github.com/libp2p/go-libp2p-kad-dht/providers"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Limits inbound DHT messages per remote peer. Safe for concurrent use.
+type inboundLimiter struct {
+	rate         float64
+	burst        float64
+	maxProviders int
+
+	lock    sync.Mutex
+	buckets map[peer.ID]*tokenBucket
+	// Keyed by peer then provided key, the value is when the record expires
+	providers         map[peer.ID]map[string]time.Time
+	lastPrune         time.Time
+	rateLimited       int
+	rejectedProviders int
+}
+
+// Returns nil if limits are disabled
+func newInboundLimiter(conf *tordht.RateLimitConf) *inboundLimiter {
+	ret := &inboundLimiter{
+		rate:         10,
+		burst:        50,
+		maxProviders: 1000,
+		buckets:      map[peer.ID]*tokenBucket{},
+		providers:    map[peer.ID]map[string]time.Time{},
+		lastPrune:    time.Now(),
+	}
+	if conf != nil {
+		if conf.Disabled {
+			return nil
+		}
+		if conf.RequestsPerSecond > 0 {
+			ret.rate = conf.RequestsPerSecond
+		}
+		if conf.Burst > 0 {
+			ret.burst = float64(conf.Burst)
+		}
+		if conf.MaxProvidersPerPeer > 0 {
+			ret.maxProviders = conf.MaxProvidersPerPeer
+		}
+	}
+	return ret
+}
+
+func (i *inboundLimiter) wrapHandler(handler inet.StreamHandler) inet.StreamHandler {
+	return func(s inet.Stream) {
+		handler(&limitedStream{Stream: s, remotePeer: s.Conn().RemotePeer(), limiter: i, reader: bufio.NewReader(s)})
+	}
+}
+
+// Errors if the message from the peer should be rejected
+func (i *inboundLimiter) allow(p peer.ID, mes *pb.Message) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	i.prune(now)
+	bucket := i.buckets[p]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: i.burst, last: now}
+		i.buckets[p] = bucket
+	}
+	if !bucket.take(now, i.rate, i.burst) {
+		i.rateLimited++
+		return fmt.Errorf("Peer %v is over the rate limit", p)
+	}
+	if mes.GetType() == pb.Message_ADD_PROVIDER {
+		keys := i.providers[p]
+		if keys == nil {
+			keys = map[string]time.Time{}
+			i.providers[p] = keys
+		}
+		// Re-providing an existing key just extends it
+		if _, ok := keys[string(mes.GetKey())]; !ok && len(keys) >= i.maxProviders {
+			i.rejectedProviders++
+			return fmt.Errorf("Peer %v is at the max of %v provider records", p, i.maxProviders)
+		}
+		keys[string(mes.GetKey())] = now.Add(providers.ProvideValidity)
+	}
+	return nil
+}
+
+// Drops full buckets and expired provider records at most once a minute. Expects the lock to be held.
+func (i *inboundLimiter) prune(now time.Time) {
+	if now.Sub(i.lastPrune) < time.Minute {
+		return
+	}
+	i.lastPrune = now
+	for p, bucket := range i.buckets {
+		if bucket.full(now, i.rate, i.burst) {
+			delete(i.buckets, p)
+		}
+	}
+	for p, keys := range i.providers {
+		for key, expires := range keys {
+			if now.After(expires) {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(i.providers, p)
+		}
+	}
+}
+
+func (i *inboundLimiter) applyStatus(status *tordht.Status) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	status.RateLimitedRequests = i.rateLimited
+	status.RejectedProviders = i.rejectedProviders
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	if t.tokens += now.Sub(t.last).Seconds() * rate; t.tokens > burst {
+		t.tokens = burst
+	}
+	t.last = now
+}
+
+func (t *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	t.refill(now, rate, burst)
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+func (t *tokenBucket) full(now time.Time, rate float64, burst float64) bool {
+	t.refill(now, rate, burst)
+	return t.tokens >= burst
+}
+
+// Reads each length-prefixed DHT message before the DHT does so it can be checked against the limits. The stream is
+// reset on the first rejected message.
+type limitedStream struct {
+	inet.Stream
+	remotePeer peer.ID
+	limiter    *inboundLimiter
+	reader     *bufio.Reader
+	// What is left of the current message for the DHT to read
+	pending []byte
+}
+
+func (l *limitedStream) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		if err := l.nextMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+func (l *limitedStream) nextMessage() error {
+	size, err := binary.ReadUvarint(l.reader)
+	if err != nil {
+		return err
+	} else if size > inet.MessageSizeMax {
+		l.Stream.Reset()
+		return fmt.Errorf("Message of %v bytes is too large", size)
+	}
+	byts := make([]byte, binary.MaxVarintLen64+int(size))
+	prefixLen := binary.PutUvarint(byts, size)
+	byts = byts[:prefixLen+int(size)]
+	if _, err = io.ReadFull(l.reader, byts[prefixLen:]); err != nil {
+		return err
+	}
+	mes := &pb.Message{}
+	if err = proto.Unmarshal(byts[prefixLen:], mes); err != nil {
+		l.Stream.Reset()
+		return fmt.Errorf("Invalid message: %v", err)
+	} else if err = l.limiter.allow(l.remotePeer, mes); err != nil {
+		l.Stream.Reset()
+		return err
+	}
+	l.pending = byts
+	return nil
+}
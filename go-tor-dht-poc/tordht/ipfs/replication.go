@@ -0,0 +1,53 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+
+	ggio "github.com/gogo/protobuf/io"
+	cid "github.com/ipfs/go-cid"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// The DHT always stores provider records on the bucket size worth of closest peers. This stores it locally and then
+// only sends it to the configured replication count of closest peers.
+func (t *torDHT) provideReplicated(ctx context.Context, c cid.Cid) error {
+	if err := t.ipfsDHT.Provide(ctx, c, false); err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	peerCh, err := t.ipfsDHT.GetClosestPeers(ctx, c.KeyString())
+	if err != nil {
+		return fmt.Errorf("Failed getting closest peers: %v", err)
+	}
+	self := t.ipfsHost.Peerstore().PeerInfo(t.ipfsHost.ID())
+	mes := pb.NewMessage(pb.Message_ADD_PROVIDER, c.Bytes(), 0)
+	mes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peerstore.PeerInfo{self})
+	sent := 0
+	peerErrs := []error{}
+	for p := range peerCh {
+		if err := t.sendMessage(ctx, p, mes); err != nil {
+			t.debugf("Failed sending provider record to %v: %v", p, err)
+			peerErrs = append(peerErrs, err)
+		} else if sent++; sent >= t.replication {
+			return nil
+		}
+	}
+	if sent == 0 && len(peerErrs) > 0 {
+		return fmt.Errorf("Failed sending provider record to any peer: %v", peerErrs)
+	}
+	return ctx.Err()
+}
+
+// Sends a message that has no response
+func (t *torDHT) sendMessage(ctx context.Context, p peer.ID, mes *pb.Message) error {
+	s, err := t.ipfsHost.NewStream(ctx, p, t.protocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return ggio.NewDelimitedWriter(s).WriteMsg(mes)
+}
@@ -0,0 +1,309 @@
+// Package sam is a minimal client for the I2P SAM v3 bridge. It only supports what is needed to dial and accept
+// streams on a single transient destination.
+package sam
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAddr is the default address of the SAM bridge on a local I2P router.
+const DefaultAddr = "127.0.0.1:7656"
+
+// B32Suffix is the suffix of all base 32 I2P addresses.
+const B32Suffix = ".b32.i2p"
+
+// I2P uses a different alphabet for base 64
+var i2pEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+var b32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Session is a SAM stream session. The session is alive as long as its control connection is open.
+type Session struct {
+	samAddr string
+	id      string
+	ctrl    net.Conn
+
+	// The full base 64 public destination
+	Destination string
+	// The destination as <base-32-hash>.b32.i2p
+	B32Addr string
+}
+
+// NewSession connects to the SAM bridge at samAddr (or DefaultAddr if empty) and creates a stream session with a new
+// transient destination.
+func NewSession(ctx context.Context, samAddr string) (*Session, error) {
+	if samAddr == "" {
+		samAddr = DefaultAddr
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("Failed generating session ID: %v", err)
+	}
+	s := &Session{samAddr: samAddr, id: "tordht-" + hex.EncodeToString(idBytes)}
+	var err error
+	if s.ctrl, err = s.connect(ctx); err != nil {
+		return nil, err
+	}
+	// Close the control conn on any error
+	defer func() {
+		if err != nil {
+			s.ctrl.Close()
+		}
+	}()
+	if _, err = command(ctx, s.ctrl, "SESSION STATUS", "SESSION CREATE STYLE=STREAM ID=%v DESTINATION=TRANSIENT "+
+		"SIGNATURE_TYPE=EdDSA_SHA512_Ed25519", s.id); err != nil {
+		return nil, fmt.Errorf("Failed creating session: %v", err)
+	}
+	if s.Destination, err = lookup(ctx, s.ctrl, "ME"); err != nil {
+		return nil, fmt.Errorf("Failed getting own destination: %v", err)
+	} else if s.B32Addr, err = DestinationToB32(s.Destination); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the control connection, ending the session and all of its streams.
+func (s *Session) Close() error { return s.ctrl.Close() }
+
+// Dial opens a stream to the given destination which can be a .b32.i2p address or a full base 64 destination.
+func (s *Session) Dial(ctx context.Context, dest string) (net.Conn, error) {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Close the conn on any error
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	if strings.HasSuffix(dest, B32Suffix) {
+		if dest, err = lookup(ctx, conn, dest); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = command(ctx, conn, "STREAM STATUS", "STREAM CONNECT ID=%v DESTINATION=%v SILENT=false",
+		s.id, dest); err != nil {
+		return nil, fmt.Errorf("Failed connecting: %v", err)
+	}
+	// Set err so the conn is closed if this fails
+	var c net.Conn
+	c, err = newConn(conn, s.B32Addr, dest)
+	return c, err
+}
+
+// Listen returns a listener for streams to this session's destination.
+func (s *Session) Listen() net.Listener {
+	return &listener{session: s, closed: make(chan struct{})}
+}
+
+// Connects to the bridge and says hello
+func (s *Session) connect(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.samAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed connecting to SAM bridge: %v", err)
+	}
+	if _, err = command(ctx, conn, "HELLO REPLY", "HELLO VERSION MIN=3.0 MAX=3.3"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed SAM handshake: %v", err)
+	}
+	return conn, nil
+}
+
+type listener struct {
+	session *Session
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// The pending accept conn, closed on listener close
+	pendingLock sync.Mutex
+	pending     net.Conn
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go func() {
+		select {
+		case <-l.closed:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err := l.session.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.pendingLock.Lock()
+	l.pending = conn
+	l.pendingLock.Unlock()
+	// Close the conn on any error, and don't let listener close touch it after
+	defer func() {
+		l.pendingLock.Lock()
+		l.pending = nil
+		l.pendingLock.Unlock()
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	if _, err = command(ctx, conn, "STREAM STATUS", "STREAM ACCEPT ID=%v SILENT=false", l.session.id); err != nil {
+		return nil, fmt.Errorf("Failed accepting: %v", err)
+	}
+	// No timeout waiting for the peer, the first line is the remote destination and maybe some port info
+	var line string
+	if line, err = readLine(conn); err != nil {
+		return nil, fmt.Errorf("Failed reading remote destination: %v", err)
+	}
+	dest := line
+	if space := strings.IndexByte(line, ' '); space >= 0 {
+		dest = line[:space]
+	}
+	// Set err so the conn is closed if this fails
+	var c net.Conn
+	c, err = newConn(conn, l.session.B32Addr, dest)
+	return c, err
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.pendingLock.Lock()
+		defer l.pendingLock.Unlock()
+		if l.pending != nil {
+			l.pending.Close()
+		}
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return Addr(l.session.B32Addr) }
+
+// Addr is a .b32.i2p address.
+type Addr string
+
+func (Addr) Network() string  { return "i2p" }
+func (a Addr) String() string { return string(a) }
+
+type conn struct {
+	net.Conn
+	localAddr  Addr
+	remoteAddr Addr
+}
+
+func newConn(c net.Conn, localB32 string, remoteDest string) (net.Conn, error) {
+	// Clear any deadline set during the commands
+	c.SetDeadline(time.Time{})
+	ret := &conn{Conn: c, localAddr: Addr(localB32), remoteAddr: Addr(remoteDest)}
+	if !strings.HasSuffix(remoteDest, B32Suffix) {
+		if b32, err := DestinationToB32(remoteDest); err != nil {
+			return nil, err
+		} else {
+			ret.remoteAddr = Addr(b32)
+		}
+	}
+	return ret, nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *conn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// DestinationToB32 converts a full base 64 destination to its <hash>.b32.i2p address.
+func DestinationToB32(dest string) (string, error) {
+	byts, err := i2pEncoding.DecodeString(dest)
+	if err != nil {
+		return "", fmt.Errorf("Invalid destination: %v", err)
+	}
+	hash := sha256.Sum256(byts)
+	return strings.ToLower(b32Encoding.EncodeToString(hash[:])) + B32Suffix, nil
+}
+
+func lookup(ctx context.Context, conn net.Conn, name string) (string, error) {
+	if vals, err := command(ctx, conn, "NAMING REPLY", "NAMING LOOKUP NAME=%v", name); err != nil {
+		return "", fmt.Errorf("Failed looking up %v: %v", name, err)
+	} else if vals["VALUE"] == "" {
+		return "", fmt.Errorf("No destination for %v", name)
+	} else {
+		return vals["VALUE"], nil
+	}
+}
+
+// Sends a command and reads a single line reply that must start with the expected prefix and have RESULT=OK (if
+// RESULT is present). Returns the key/value pairs of the reply.
+func command(ctx context.Context, conn net.Conn, replyPrefix string, format string, args ...interface{}) (
+	map[string]string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(conn, format+"\n", args...); err != nil {
+		return nil, err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	} else if !strings.HasPrefix(line, replyPrefix+" ") {
+		return nil, fmt.Errorf("Expected '%v' reply, got: %v", replyPrefix, line)
+	}
+	vals := parseValues(line[len(replyPrefix)+1:])
+	if result, ok := vals["RESULT"]; ok && result != "OK" {
+		if msg := vals["MESSAGE"]; msg != "" {
+			return nil, fmt.Errorf("SAM error %v: %v", result, msg)
+		}
+		return nil, fmt.Errorf("SAM error %v", result)
+	}
+	return vals, nil
+}
+
+// Reads a byte at a time so nothing past the newline is consumed from the stream
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		} else if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+// Parses space-separated KEY=VALUE pairs, values may be double quoted
+func parseValues(str string) map[string]string {
+	ret := map[string]string{}
+	for str = strings.TrimSpace(str); str != ""; str = strings.TrimSpace(str) {
+		// Key is up to the equals or space
+		keyEnd := strings.IndexAny(str, "= ")
+		if keyEnd == -1 {
+			ret[str] = ""
+			break
+		} else if str[keyEnd] == ' ' {
+			ret[str[:keyEnd]] = ""
+			str = str[keyEnd:]
+			continue
+		}
+		key := str[:keyEnd]
+		str = str[keyEnd+1:]
+		if strings.HasPrefix(str, "\"") {
+			if end := strings.IndexByte(str[1:], '"'); end == -1 {
+				ret[key], str = str[1:], ""
+			} else {
+				ret[key], str = str[1:end+1], str[end+2:]
+			}
+		} else if end := strings.IndexByte(str, ' '); end == -1 {
+			ret[key], str = str, ""
+		} else {
+			ret[key], str = str[:end], str[end:]
+		}
+	}
+	return ret
+}
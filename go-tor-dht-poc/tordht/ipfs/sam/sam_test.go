@@ -0,0 +1,331 @@
+package sam
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake SAM bridge with a single destination that streams can be connected to. Replies can be overridden per
+// command to test errors.
+type fakeBridge struct {
+	t        *testing.T
+	listener net.Listener
+	dest     string
+
+	lock sync.Mutex
+	// Keyed by command, e.g. "HELLO", the whole reply line
+	replies   map[string]string
+	accepting []net.Conn
+	// Closed when a bridge side conn sees the client close it
+	clientClosed chan struct{}
+}
+
+func newFakeBridge(t *testing.T) *fakeBridge {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destBytes := make([]byte, 387)
+	if _, err = rand.Read(destBytes); err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBridge{
+		t:            t,
+		listener:     listener,
+		dest:         i2pEncoding.EncodeToString(destBytes),
+		replies:      map[string]string{},
+		clientClosed: make(chan struct{}, 100),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *fakeBridge) Close() { b.listener.Close() }
+
+func (b *fakeBridge) addr() string { return b.listener.Addr().String() }
+
+// Empty reply removes the override
+func (b *fakeBridge) setReply(command string, reply string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if reply == "" {
+		delete(b.replies, command)
+	} else {
+		b.replies[command] = reply
+	}
+}
+
+func (b *fakeBridge) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serveConn(conn)
+	}
+}
+
+func (b *fakeBridge) serveConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			if err == io.EOF {
+				b.clientClosed <- struct{}{}
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		pieces := strings.SplitN(line, " ", 3)
+		if len(pieces) < 2 {
+			fmt.Fprintf(conn, "ERROR RESULT=I2P_ERROR\n")
+			continue
+		}
+		vals := parseValues(pieces[len(pieces)-1])
+		b.lock.Lock()
+		reply, ok := b.replies[pieces[0]]
+		b.lock.Unlock()
+		if ok {
+			fmt.Fprintf(conn, "%v\n", reply)
+			continue
+		}
+		switch pieces[0] {
+		case "HELLO":
+			fmt.Fprintf(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case "SESSION":
+			fmt.Fprintf(conn, "SESSION STATUS RESULT=OK DESTINATION=TRANSIENT\n")
+		case "NAMING":
+			if name := vals["NAME"]; name == "ME" {
+				fmt.Fprintf(conn, "NAMING REPLY RESULT=OK NAME=ME VALUE=%v\n", b.dest)
+			} else if b32, _ := DestinationToB32(b.dest); name == b32 {
+				fmt.Fprintf(conn, "NAMING REPLY RESULT=OK NAME=%v VALUE=%v\n", name, b.dest)
+			} else {
+				fmt.Fprintf(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME=%v\n", name)
+			}
+		case "STREAM":
+			if pieces[1] == "ACCEPT" {
+				fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+				b.lock.Lock()
+				b.accepting = append(b.accepting, conn)
+				b.lock.Unlock()
+				// The conn belongs to the stream now
+				return
+			} else if pieces[1] != "CONNECT" || vals["DESTINATION"] != b.dest {
+				fmt.Fprintf(conn, "STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE=\"Unknown peer\"\n")
+				continue
+			}
+			b.lock.Lock()
+			var accepter net.Conn
+			if len(b.accepting) > 0 {
+				accepter, b.accepting = b.accepting[0], b.accepting[1:]
+			}
+			b.lock.Unlock()
+			if accepter == nil {
+				fmt.Fprintf(conn, "STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE=\"Not accepting\"\n")
+				continue
+			}
+			fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+			fmt.Fprintf(accepter, "%v FROM_PORT=0 TO_PORT=0\n", b.dest)
+			go func() {
+				io.Copy(conn, accepter)
+				conn.Close()
+			}()
+			io.Copy(accepter, reader)
+			accepter.Close()
+			return
+		default:
+			fmt.Fprintf(conn, "%v STATUS RESULT=I2P_ERROR\n", pieces[0])
+		}
+	}
+}
+
+// Waits for the pending accept to reach the bridge
+func (b *fakeBridge) waitAccepting(count int) {
+	for i := 0; i < 100; i++ {
+		b.lock.Lock()
+		n := len(b.accepting)
+		b.lock.Unlock()
+		if n >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.t.Fatalf("Accept never reached the bridge")
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func TestSessionStream(t *testing.T) {
+	ctx, cancelFn := testContext()
+	defer cancelFn()
+	b := newFakeBridge(t)
+	defer b.Close()
+	s, err := NewSession(ctx, b.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Destination != b.dest {
+		t.Fatalf("Expected destination %v, got %v", b.dest, s.Destination)
+	} else if b32, _ := DestinationToB32(b.dest); s.B32Addr != b32 {
+		t.Fatalf("Expected b32 %v, got %v", b32, s.B32Addr)
+	}
+	listener := s.Listen()
+	defer listener.Close()
+	acceptedCh := make(chan net.Conn, 1)
+	acceptErrCh := make(chan error, 1)
+	go func() {
+		if conn, err := listener.Accept(); err != nil {
+			acceptErrCh <- err
+		} else {
+			acceptedCh <- conn
+		}
+	}()
+	b.waitAccepting(1)
+	dialed, err := s.Dial(ctx, s.B32Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	var accepted net.Conn
+	select {
+	case accepted = <-acceptedCh:
+		defer accepted.Close()
+	case err := <-acceptErrCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	if accepted.RemoteAddr().String() != s.B32Addr || dialed.RemoteAddr().String() != s.B32Addr {
+		t.Fatalf("Expected remote addrs of %v, got %v and %v", s.B32Addr, accepted.RemoteAddr(), dialed.RemoteAddr())
+	}
+	// Both directions
+	if _, err = dialed.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	} else if line, err := readLine(accepted); err != nil || line != "ping" {
+		t.Fatalf("Expected ping, got %v (err: %v)", line, err)
+	} else if _, err = accepted.Write([]byte("pong\n")); err != nil {
+		t.Fatal(err)
+	} else if line, err = readLine(dialed); err != nil || line != "pong" {
+		t.Fatalf("Expected pong, got %v (err: %v)", line, err)
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	ctx, cancelFn := testContext()
+	defer cancelFn()
+	for command, reply := range map[string]string{
+		"HELLO":   "HELLO REPLY RESULT=NOVERSION",
+		"SESSION": "SESSION STATUS RESULT=DUPLICATED_ID",
+		"NAMING":  "NAMING REPLY RESULT=KEY_NOT_FOUND NAME=ME",
+	} {
+		b := newFakeBridge(t)
+		b.setReply(command, reply)
+		if s, err := NewSession(ctx, b.addr()); err == nil {
+			s.Close()
+			t.Fatalf("Expected %v failure", command)
+		} else if result := parseValues(reply)["RESULT"]; !strings.Contains(err.Error(), result) {
+			t.Fatalf("Expected %v in error, got: %v", result, err)
+		}
+		b.Close()
+	}
+	// Unreachable bridge
+	b := newFakeBridge(t)
+	b.Close()
+	if _, err := NewSession(ctx, b.addr()); err == nil {
+		t.Fatal("Expected failure with no bridge")
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	ctx, cancelFn := testContext()
+	defer cancelFn()
+	b := newFakeBridge(t)
+	defer b.Close()
+	s, err := NewSession(ctx, b.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Each failure has to close the conn to the bridge
+	expectClosed := func() {
+		select {
+		case <-b.clientClosed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Conn to bridge not closed")
+		}
+	}
+	if _, err = s.Dial(ctx, "unknown"+B32Suffix); err == nil || !strings.Contains(err.Error(), "KEY_NOT_FOUND") {
+		t.Fatalf("Expected lookup failure, got: %v", err)
+	}
+	expectClosed()
+	// Nothing is accepting
+	if _, err = s.Dial(ctx, b.dest); err == nil || !strings.Contains(err.Error(), "CANT_REACH_PEER") {
+		t.Fatalf("Expected connect failure, got: %v", err)
+	}
+	expectClosed()
+	// The bridge accepts it but it's not a valid destination
+	b.setReply("STREAM", "STREAM STATUS RESULT=OK")
+	if _, err = s.Dial(ctx, "not-base64!"); err == nil {
+		t.Fatal("Expected invalid destination failure")
+	}
+	expectClosed()
+}
+
+func TestAcceptErrors(t *testing.T) {
+	ctx, cancelFn := testContext()
+	defer cancelFn()
+	b := newFakeBridge(t)
+	defer b.Close()
+	s, err := NewSession(ctx, b.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b.setReply("STREAM", "STREAM STATUS RESULT=I2P_ERROR MESSAGE=\"Session gone\"")
+	listener := s.Listen()
+	if _, err = listener.Accept(); err == nil || !strings.Contains(err.Error(), "Session gone") {
+		t.Fatalf("Expected accept failure, got: %v", err)
+	}
+	// Close unblocks a pending accept
+	b.setReply("STREAM", "")
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		errCh <- err
+	}()
+	b.waitAccepting(1)
+	listener.Close()
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Fatal("Expected accept to fail after close")
+		}
+	case <-ctx.Done():
+		t.Fatal("Accept not unblocked by close")
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	vals := parseValues(`RESULT=OK MESSAGE="with spaces" EMPTY= FLAG VALUE=abc==`)
+	expected := map[string]string{"RESULT": "OK", "MESSAGE": "with spaces", "EMPTY": "", "FLAG": "", "VALUE": "abc=="}
+	if len(vals) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, vals)
+	}
+	for k, v := range expected {
+		if vals[k] != v {
+			t.Fatalf("Expected %v=%v, got %v", k, v, vals[k])
+		}
+	}
+}
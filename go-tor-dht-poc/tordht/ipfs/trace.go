@@ -0,0 +1,87 @@
+package ipfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// If the context has a trace, the DHT's query events are recorded into it until the returned func is called with the
+// query's error
+func (t *torDHT) startTrace(ctx context.Context, c cid.Cid) (context.Context, func(error)) {
+	trace := tordht.TraceFromContext(ctx)
+	if trace == nil {
+		return ctx, func(error) {}
+	}
+	trace.Key = c.String()
+	trace.Started = time.Now()
+	// The events channel is closed once the context is done
+	ctx, events := notif.RegisterForQueryEvents(ctx)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		rec := &traceRecorder{trace: trace, peers: map[peer.ID]*tordht.TracePeer{}}
+		for {
+			select {
+			case <-stop:
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				rec.record(ev, time.Now())
+			}
+		}
+	}()
+	return ctx, func(err error) {
+		close(stop)
+		<-done
+		trace.Finished = time.Now()
+		if err != nil {
+			trace.Error = err.Error()
+		}
+	}
+}
+
+type traceRecorder struct {
+	trace *tordht.Trace
+	peers map[peer.ID]*tordht.TracePeer
+}
+
+func (r *traceRecorder) record(ev *notif.QueryEvent, now time.Time) {
+	switch ev.Type {
+	case notif.DialingPeer, notif.SendingQuery:
+		if p := r.peer(ev.ID, nil); p.Queried.IsZero() {
+			p.Queried = now
+		}
+	case notif.PeerResponse:
+		p := r.peer(ev.ID, nil)
+		if !p.Queried.IsZero() {
+			p.Latency = now.Sub(p.Queried)
+		}
+		for _, resp := range ev.Responses {
+			r.peer(resp.ID, p)
+			p.CloserPeers = append(p.CloserPeers, resp.ID.Pretty())
+		}
+	case notif.QueryError:
+		r.peer(ev.ID, nil).Error = ev.Extra
+	}
+}
+
+// Gets the peer, adding it if not there. If from is nil, a new peer is one we knew before the query.
+func (r *traceRecorder) peer(id peer.ID, from *tordht.TracePeer) *tordht.TracePeer {
+	if p := r.peers[id]; p != nil {
+		return p
+	}
+	p := &tordht.TracePeer{ID: id.Pretty()}
+	if from != nil {
+		p.Hop, p.LearnedFrom = from.Hop+1, from.ID
+	}
+	r.peers[id] = p
+	r.trace.Peers = append(r.trace.Peers, p)
+	return p
+}
@@ -3,17 +3,18 @@ package ipfs
 import (
 	"context"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
-	"sync"
 	"time"
 
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
 	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/ipfs/websocket"
 	gorillaws "github.com/gorilla/websocket"
 
 	"github.com/whyrusleeping/mafmt"
 
-	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
 	"github.com/libp2p/go-libp2p-peer"
 	"github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
@@ -22,136 +23,150 @@ import (
 	upgrader "github.com/libp2p/go-libp2p-transport-upgrader"
 )
 
-// impls libp2p's transport.Transport
+// impls libp2p's transport.Transport over an onion network, usually Tor
 type TorTransport struct {
-	bineTor  *tor.Tor
-	conf     *TorTransportConf
-	upgrader *upgrader.Upgrader
-
-	dialerLock sync.Mutex
-	torDialer  *tor.Dialer
-	wsDialer   *gorillaws.Dialer
+	network    tordht.OnionNetwork
+	conf       *TorTransportConf
+	upgrader   *upgrader.Upgrader
+	addrFormat addrFormat
 }
 
 type TorTransportConf struct {
-	DialConf  *tor.DialConf
-	WebSocket bool
+	// The key of the onion service created when listening on "/onionListen". Required to listen.
+	ListenKey ed25519.KeyPair
+	// How long to wait for the onion service to be published when listening. Defaults to 1 minute.
+	ListenTimeout time.Duration
+	WebSocket     bool
+	// The format listen addresses are output in. Every format is accepted when dialing.
+	AddrFormat AddrFormat
+	// If true, dialing fails unless the peer ID was derived from the onion's key
+	VerifyOnionPeerID bool
+	Verbose           bool
 }
 
-var OnionMultiaddrFormat = mafmt.Base(ma.P_ONION)
+var OnionMultiaddrFormat = mafmt.Or(mafmt.Base(ma.P_ONION3), mafmt.Base(ma.P_ONION))
 var TorMultiaddrFormat = mafmt.Or(OnionMultiaddrFormat, mafmt.TCP)
 
 var _ transport.Transport = &TorTransport{}
 
-func NewTorTransport(bineTor *tor.Tor, conf *TorTransportConf) func(*upgrader.Upgrader) *TorTransport {
-	return func(upgrader *upgrader.Upgrader) *TorTransport {
-		bineTor.Debugf("Creating transport with upgrader: %v", upgrader)
+// NewTorTransport creates the transport constructor for libp2p. Use tordht.NewTorNetwork for the network to run over
+// Tor.
+func NewTorTransport(network tordht.OnionNetwork, conf *TorTransportConf) func(*upgrader.Upgrader) (
+	*TorTransport, error) {
+	return func(upgrader *upgrader.Upgrader) (*TorTransport, error) {
 		if conf == nil {
 			conf = &TorTransportConf{}
 		}
-		return &TorTransport{bineTor: bineTor, conf: conf, upgrader: upgrader}
+		addrFormat, err := newAddrFormat(conf.AddrFormat)
+		if err != nil {
+			return nil, err
+		} else if err = registerProtocols(); err != nil {
+			return nil, err
+		}
+		return &TorTransport{network: network, conf: conf, upgrader: upgrader, addrFormat: addrFormat}, nil
 	}
 }
 
 func (t *TorTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
-	t.bineTor.Debugf("For peer ID %v, dialing %v", p, raddr)
-	var addr string
-	if onionID, port, err := defaultAddrFormat.onionInfo(raddr); err != nil {
+	t.debugf("For peer ID %v, dialing %v", p, raddr)
+	onionID, port, err := t.addrFormat.onionInfo(raddr)
+	if err != nil {
 		return nil, err
-	} else {
-		addr = fmt.Sprintf("%v.onion:%v", onionID, port)
-	}
-	// Init the dialers
-	if err := t.initDialers(ctx); err != nil {
-		t.bineTor.Debugf("Failed initializing dialers: %v", err)
+	} else if err = t.verifyOnionPeerID(onionID, p); err != nil {
+		t.debugf("Failed verifying peer: %v", err)
 		return nil, err
 	}
 	// Now dial
 	var netConn net.Conn
-	if t.wsDialer != nil {
-		t.bineTor.Debugf("Dialing addr: ws://%v", addr)
-		wsConn, _, err := t.wsDialer.Dial("ws://"+addr, nil)
+	if t.conf.WebSocket {
+		addr := fmt.Sprintf("%v.onion:%v", onionID, port)
+		t.debugf("Dialing addr: ws://%v", addr)
+		wsDialer := &gorillaws.Dialer{
+			NetDial:          func(string, string) (net.Conn, error) { return t.network.Dial(ctx, onionID, port) },
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 45 * time.Second,
+		}
+		wsConn, _, err := wsDialer.Dial("ws://"+addr, nil)
 		if err != nil {
-			t.bineTor.Debugf("Failed dialing: %v", err)
+			t.debugf("Failed dialing: %v", err)
 			return nil, err
 		}
 		netConn = websocket.NewConn(wsConn, nil)
-	} else {
-		var err error
-		if netConn, err = t.torDialer.DialContext(ctx, "tcp", addr); err != nil {
-			t.bineTor.Debugf("Failed dialing: %v", err)
-			return nil, err
-		}
+	} else if netConn, err = t.network.Dial(ctx, onionID, port); err != nil {
+		t.debugf("Failed dialing: %v", err)
+		return nil, err
 	}
 	// Convert connection
-	if manetConn, err := manet.WrapNetConn(netConn); err != nil {
-		t.bineTor.Debugf("Failed wrapping the net connection: %v", err)
-		return nil, err
-	} else if conn, err := t.upgrader.UpgradeOutbound(ctx, t, manetConn, p); err != nil {
-		t.bineTor.Debugf("Failed upgrading connection: %v", err)
+	if conn, err := t.upgrader.UpgradeOutbound(ctx, t, t.wrapConn(netConn, raddr), p); err != nil {
+		t.debugf("Failed upgrading connection: %v", err)
 		return nil, err
 	} else {
 		return conn, nil
 	}
 }
 
-func (t *TorTransport) initDialers(ctx context.Context) error {
-	t.dialerLock.Lock()
-	defer t.dialerLock.Unlock()
-	// If already inited, good enough
-	if t.torDialer != nil {
+// Since the onion service is authenticated by Tor, confirming the key matches before dial is enough
+func (t *TorTransport) verifyOnionPeerID(onionID string, p peer.ID) error {
+	if !t.conf.VerifyOnionPeerID {
 		return nil
-	}
-	var err error
-	if t.torDialer, err = t.bineTor.Dialer(ctx, t.conf.DialConf); err != nil {
-		return fmt.Errorf("Failed creating tor dialer: %v", err)
-	}
-	// Create web socket dialer if needed
-	if t.conf.WebSocket {
-		t.wsDialer = &gorillaws.Dialer{
-			NetDial:          t.torDialer.Dial,
-			Proxy:            http.ProxyFromEnvironment,
-			HandshakeTimeout: 45 * time.Second,
-		}
+	} else if expected, err := peerIDFromOnion(onionID); err != nil {
+		return err
+	} else if expected != p {
+		return fmt.Errorf("Onion %v is for peer %v, not %v", onionID, expected.Pretty(), p.Pretty())
 	}
 	return nil
 }
 
+// Uses the conn's net addresses if they convert, otherwise the given fallback. Non-Tor networks may not have IP
+// addresses.
+func (t *TorTransport) wrapConn(c net.Conn, fallback ma.Multiaddr) manet.Conn {
+	if conn, err := manet.WrapNetConn(c); err == nil {
+		return conn
+	}
+	return &manetConn{Conn: c, localMultiaddr: fallback, remoteMultiaddr: fallback}
+}
+
 func (t *TorTransport) CanDial(addr ma.Multiaddr) bool {
-	t.bineTor.Debugf("Checking if can dial %v", addr)
-	_, _, err := defaultAddrFormat.onionInfo(addr)
+	t.debugf("Checking if can dial %v", addr)
+	_, _, err := t.addrFormat.onionInfo(addr)
 	return err == nil
 }
 
 func (t *TorTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
 	// TODO: support a bunch of config options on this if we want
-	t.bineTor.Debugf("Called listen for %v", laddr)
+	t.debugf("Called listen for %v", laddr)
 	if val, err := laddr.ValueForProtocol(ONION_LISTEN_PROTO_CODE); err != nil {
 		return nil, fmt.Errorf("Unable to get protocol value: %v", err)
 	} else if val != "" {
 		return nil, fmt.Errorf("Must be '/onionListen', got '/onionListen/%v'", val)
+	} else if t.conf.ListenKey == nil {
+		return nil, fmt.Errorf("No listen key")
 	}
-	// Listen with version 3, wait 1 min for bootstrap
-	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Minute)
+	// Wait 1 min for bootstrap by default
+	listenTimeout := t.conf.ListenTimeout
+	if listenTimeout == 0 {
+		listenTimeout = 1 * time.Minute
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), listenTimeout)
 	defer cancelFn()
-	onion, err := t.bineTor.Listen(ctx, &tor.ListenConf{Version3: true})
+	onion, err := t.network.Listen(ctx, t.conf.ListenKey)
 	if err != nil {
-		t.bineTor.Debugf("Failed creating onion service: %v", err)
+		t.debugf("Failed creating onion service: %v", err)
 		return nil, err
 	}
 
-	t.bineTor.Debugf("Listening on onion: %v", onion.String())
+	t.debugf("Listening on onion: %v", onion.OnionServiceID())
 	// Close it if there is another error in here
 	defer func() {
 		if err != nil {
-			t.bineTor.Debugf("Failed listen after onion creation: %v", err)
+			t.debugf("Failed listen after onion creation: %v", err)
 			onion.Close()
 		}
 	}()
 
 	// Return a listener
 	manetListen := &manetListener{transport: t, onion: onion, listener: onion}
-	addrStr := defaultAddrFormat.onionAddr(onion.ID, onion.RemotePorts[0])
+	addrStr := t.addrFormat.onionAddr(onion.OnionServiceID(), onion.OnionPort())
 	if t.conf.WebSocket {
 		addrStr += "/ws"
 	}
@@ -165,16 +180,24 @@ func (t *TorTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
 		}
 	}
 
-	t.bineTor.Debugf("Completed creating IPFS listener from onion, addr: %v", manetListen.multiaddr)
+	t.debugf("Completed creating IPFS listener from onion, addr: %v", manetListen.multiaddr)
 	return manetListen.Upgrade(t.upgrader), nil
 }
 
-func (t *TorTransport) Protocols() []int { return []int{ma.P_TCP, ma.P_ONION, ONION_LISTEN_PROTO_CODE} }
-func (t *TorTransport) Proxy() bool      { return true }
+func (t *TorTransport) Protocols() []int {
+	return []int{ma.P_TCP, ma.P_ONION, ma.P_ONION3, ONION_LISTEN_PROTO_CODE}
+}
+func (t *TorTransport) Proxy() bool { return true }
+
+func (t *TorTransport) debugf(format string, args ...interface{}) {
+	if t.conf.Verbose {
+		log.Printf("[DEBUG] [Tor] "+format, args...)
+	}
+}
 
 type manetListener struct {
 	transport *TorTransport
-	onion     *tor.OnionService
+	onion     tordht.OnionListener
 	multiaddr ma.Multiaddr
 	listener  net.Listener
 }
@@ -183,15 +206,16 @@ func (m *manetListener) Accept() (manet.Conn, error) {
 	if c, err := m.listener.Accept(); err != nil {
 		return nil, err
 	} else {
-		ret := &manetConn{Conn: c, localMultiaddr: m.multiaddr}
-		if ret.remoteMultiaddr, err = manet.FromNetAddr(c.RemoteAddr()); err != nil {
-			return nil, err
+		// Inbound onion conns are anonymous, so non-IP remote addresses just use ours
+		ret := &manetConn{Conn: c, localMultiaddr: m.multiaddr, remoteMultiaddr: m.multiaddr}
+		if remote, err := manet.FromNetAddr(c.RemoteAddr()); err == nil {
+			ret.remoteMultiaddr = remote
 		}
 		return ret, nil
 	}
 }
 func (m *manetListener) Close() error            { return m.onion.Close() }
-func (m *manetListener) Addr() net.Addr          { return m.onion }
+func (m *manetListener) Addr() net.Addr          { return m.onion.Addr() }
 func (m *manetListener) Multiaddr() ma.Multiaddr { return m.multiaddr }
 func (m *manetListener) Upgrade(u *upgrader.Upgrader) transport.Listener {
 	return u.UpgradeListener(m.transport, m)
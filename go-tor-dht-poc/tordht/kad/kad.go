@@ -0,0 +1,473 @@
+// Package kad is a small Kademlia DHT that runs directly over onion service streams. Node IDs are derived from onion
+// keys and provider records are signed by them.
+package kad
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+type impl struct{}
+
+var kadImpl = impl{}
+var Impl tordht.Impl = kadImpl
+
+func init() { tordht.Register(Impl) }
+
+// The default protocol ID, peers with a different one are rejected
+const ProtocolID = "/tordht/kad/1.0.0"
+
+// Version is the implementation version put in peer infos. Bump the major version when the protocol ID changes.
+const Version = "1.0.0"
+
+const minPeersRequired = 2
+
+func (impl) Name() string    { return "kad" }
+func (impl) Version() string { return Version }
+
+// Only the required features are supported
+func (impl) Capabilities() tordht.Capabilities { return tordht.Capabilities{} }
+
+// Logging is only controlled by DHTConf.Verbose
+func (impl) ApplyDebugLogging() {}
+
+func (impl) RawStringDataID(id []byte, conf *tordht.DataIDConf) (string, error) {
+	if raw, err := tordht.HashDataID(id, conf); err != nil {
+		return "", err
+	} else {
+		return raw.String(), nil
+	}
+}
+
+// Node IDs always come from the onion key, the peer key and onion identity aren't used
+func (impl) IdentityPeerInfo(conf *tordht.DHTConf) (*tordht.PeerInfo, error) {
+	if conf.OnionKey == nil {
+		return nil, fmt.Errorf("OnionKey required")
+	}
+	onionID := torutil.OnionServiceIDFromV3PublicKey(conf.OnionKey.PublicKey())
+	if id, err := nodeIDFromOnion(onionID); err != nil {
+		return nil, err
+	} else {
+		return &tordht.PeerInfo{
+			Impl:           kadImpl.Name(),
+			ImplVersion:    Version,
+			ID:             id.String(),
+			OnionServiceID: onionID,
+		}, nil
+	}
+}
+
+type kadDHT struct {
+	debug      bool
+	network    tordht.OnionNetwork
+	dataIDConf *tordht.DataIDConf
+	protocolID string
+	// The k, alpha, and replication values
+	bucketSize   int
+	alpha        int
+	replication  int
+	queryTimeout time.Duration
+	// Random for client-only nodes
+	selfID nodeID
+	// Nil for client-only nodes
+	self      *tordht.PeerInfo
+	onionKey  ed25519.KeyPair
+	listener  tordht.OnionListener
+	serveDone chan struct{}
+	table     *routingTable
+	providers *providerStore
+
+	// Guards closed, conns, inbound, and learning
+	connsLock sync.Mutex
+	closed    bool
+	conns     map[string]*peerConn
+	inbound   map[net.Conn]struct{}
+	// Peers being pinged before they're added to the routing table
+	learning map[nodeID]bool
+
+	bootstrapPeers    []*tordht.PeerInfo
+	maintenanceCancel context.CancelFunc
+	maintenanceDone   chan struct{}
+	statusLock        sync.Mutex
+	status            tordht.Status
+	// Nil if providers aren't pinged before returning
+	verifyProviders *tordht.VerifyProvidersConf
+	// Nil if inbound requests aren't limited
+	requestLimit *requestLimit
+}
+
+func (impl) NewDHT(ctx context.Context, conf *tordht.DHTConf) (tordht.DHT, error) {
+	if conf.I2P != nil {
+		return nil, fmt.Errorf("I2P is not supported by the kad implementation")
+	} else if len(conf.SwarmKey) > 0 {
+		return nil, fmt.Errorf("Swarm keys are not supported by the kad implementation")
+	} else if conf.PeerCacheFile != "" {
+		return nil, fmt.Errorf("Peer cache files are not supported by the kad implementation")
+	}
+	for _, peer := range conf.BootstrapPeers {
+		if err := peer.CheckImpl(Impl); err != nil {
+			return nil, err
+		}
+	}
+	k := &kadDHT{
+		debug:           conf.Verbose,
+		network:         conf.Network,
+		dataIDConf:      conf.DataID,
+		protocolID:      ProtocolID,
+		bucketSize:      20,
+		alpha:           3,
+		conns:           map[string]*peerConn{},
+		inbound:         map[net.Conn]struct{}{},
+		learning:        map[nodeID]bool{},
+		bootstrapPeers:  conf.BootstrapPeers,
+		verifyProviders: conf.VerifyProviders,
+	}
+	if k.network == nil && conf.Tor != nil {
+		k.network = tordht.NewTorNetwork(conf.Tor, nil)
+	} else if k.network == nil {
+		return nil, fmt.Errorf("Network or Tor must be set")
+	}
+	if conf.Kademlia != nil {
+		if conf.Kademlia.ProtocolID != "" {
+			k.protocolID = conf.Kademlia.ProtocolID
+		}
+		if conf.Kademlia.BucketSize > 0 {
+			k.bucketSize = conf.Kademlia.BucketSize
+		}
+		if conf.Kademlia.Alpha > 0 {
+			k.alpha = conf.Kademlia.Alpha
+		}
+		k.replication = conf.Kademlia.Replication
+		k.queryTimeout = conf.Kademlia.QueryTimeout
+	}
+	if k.replication <= 0 {
+		k.replication = k.bucketSize
+	}
+	maxProvidersPerPeer := 1000
+	if conf.RateLimit != nil && conf.RateLimit.MaxProvidersPerPeer > 0 {
+		maxProvidersPerPeer = conf.RateLimit.MaxProvidersPerPeer
+	}
+	k.providers = newProviderStore(maxProvidersPerPeer)
+	k.requestLimit = newRequestLimit(conf.RateLimit)
+	// Close the dht on any error when creating, so make sure err is populated before returning
+	var err error
+	defer func() {
+		if err != nil {
+			k.Close()
+		}
+	}()
+
+	if conf.ClientOnly {
+		// Only used to measure distance, never told to anyone
+		if _, err = rand.Read(k.selfID[:]); err != nil {
+			return nil, fmt.Errorf("Failed generating ID: %v", err)
+		}
+	} else {
+		listenTimeout := conf.ListenTimeout
+		if listenTimeout <= 0 {
+			listenTimeout = 1 * time.Minute
+		}
+		listenCtx, listenCancel := context.WithTimeout(ctx, listenTimeout)
+		defer listenCancel()
+		if k.onionKey = conf.OnionKey; k.onionKey == nil {
+			if k.onionKey, err = ed25519.GenerateKey(nil); err != nil {
+				return nil, fmt.Errorf("Failed generating onion key: %v", err)
+			}
+		}
+		if k.listener, err = k.network.Listen(listenCtx, k.onionKey); err != nil {
+			return nil, fmt.Errorf("Failed creating onion service: %v", err)
+		} else if k.selfID, err = nodeIDFromOnion(k.listener.OnionServiceID()); err != nil {
+			return nil, err
+		}
+		k.self = &tordht.PeerInfo{
+			Impl:           kadImpl.Name(),
+			ImplVersion:    Version,
+			ID:             k.selfID.String(),
+			OnionServiceID: k.listener.OnionServiceID(),
+			OnionPort:      k.listener.OnionPort(),
+		}
+		k.debugf("Listening on %v", k.self)
+	}
+	k.table = newRoutingTable(k.selfID, k.bucketSize)
+	if k.listener != nil {
+		k.serveDone = make(chan struct{})
+		go k.serve()
+	}
+
+	// Connect to at least X (or total count if fewer than X), then fill the routing table with a lookup of ourselves
+	if len(conf.BootstrapPeers) > 0 {
+		if err = k.pingPeers(ctx, conf.BootstrapPeers, minPeersRequired); err != nil {
+			return nil, fmt.Errorf("Failed connecting to peers: %v", err)
+		}
+		k.debugf("Bootstrapping DHT")
+		if err = k.refresh(ctx); err != nil {
+			return nil, fmt.Errorf("Failed boostrapping DHT: %v", err)
+		}
+	}
+	k.startMaintenance(conf.Maintenance)
+	return k, nil
+}
+
+func (k *kadDHT) Close() (err error) {
+	k.stopMaintenance()
+	k.connsLock.Lock()
+	k.closed = true
+	conns := make([]net.Conn, 0, len(k.conns)+len(k.inbound))
+	for _, pc := range k.conns {
+		// The lock may be held by a request, so it's closed in the background
+		go func(pc *peerConn) {
+			pc.lock.Lock()
+			defer pc.lock.Unlock()
+			pc.closed = true
+			if pc.conn != nil {
+				pc.conn.Close()
+				pc.conn = nil
+			}
+		}(pc)
+	}
+	for conn := range k.inbound {
+		conns = append(conns, conn)
+	}
+	k.conns = map[string]*peerConn{}
+	k.connsLock.Unlock()
+	if k.listener != nil {
+		err = k.listener.Close()
+		if k.serveDone != nil {
+			<-k.serveDone
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return
+}
+
+func (k *kadDHT) PeerInfo() *tordht.PeerInfo { return k.self }
+
+func (k *kadDHT) Provide(ctx context.Context, id []byte, metadata []byte) (err error) {
+	ctx, cancelFn := k.queryContext(ctx)
+	defer cancelFn()
+	cid, err := tordht.HashDataID(id, k.dataIDConf)
+	if err != nil {
+		return err
+	}
+	finishTrace := k.startTrace(ctx, cid.String())
+	defer func() { finishTrace(err) }()
+	if k.self == nil {
+		return fmt.Errorf("Must be listening on an onion service to provide")
+	} else if len(metadata) > tordht.MaxProviderMetadataSize {
+		return fmt.Errorf("Metadata is %v bytes, max is %v", len(metadata), tordht.MaxProviderMetadataSize)
+	}
+	target := keyID(cid.Bytes())
+	rec := newProviderRecord(cid, k.self, metadata, k.onionKey)
+	// Store it ourselves then on the closest peers
+	if err = k.providers.add(target, rec); err != nil {
+		return err
+	}
+	k.debugf("Providing CID: %v", cid)
+	closest, err := k.lookup(ctx, target, nil)
+	if err != nil {
+		return fmt.Errorf("Failed getting closest peers: %v", err)
+	} else if len(closest) > k.replication {
+		closest = closest[:k.replication]
+	}
+	errCh := make(chan error, len(closest))
+	for _, peer := range closest {
+		go func(peer *tordht.PeerInfo) {
+			_, err := k.request(ctx, peer, &message{
+				Type:      messageAddProvider,
+				Key:       target[:],
+				Providers: []*providerRecord{rec},
+			})
+			errCh <- err
+		}(peer)
+	}
+	peerErrs := []error{}
+	for range closest {
+		if peerErr := <-errCh; peerErr != nil {
+			k.debugf("Failed sending provider record: %v", peerErr)
+			peerErrs = append(peerErrs, peerErr)
+		}
+	}
+	if len(closest) > 0 && len(peerErrs) == len(closest) {
+		return fmt.Errorf("Failed sending provider record to any peer: %v", peerErrs)
+	}
+	return nil
+}
+
+func (k *kadDHT) FindProviders(ctx context.Context, id []byte, maxCount int) (ret []*tordht.PeerInfo, err error) {
+	ctx, cancelFn := k.queryContext(ctx)
+	defer cancelFn()
+	cid, err := tordht.HashDataID(id, k.dataIDConf)
+	if err != nil {
+		return nil, err
+	}
+	finishTrace := k.startTrace(ctx, cid.String())
+	defer func() { finishTrace(err) }()
+	k.debugf("Finding providers for CID: %v", cid)
+	target := keyID(cid.Bytes())
+	ret = []*tordht.PeerInfo{}
+	seen := map[string]bool{}
+	// Returns true when there are enough
+	addProviders := func(recs []*providerRecord) bool {
+		for _, rec := range recs {
+			if maxCount > 0 && len(ret) >= maxCount {
+				break
+			} else if err := rec.verify(target); err != nil {
+				// Forged or mismatched providers are dropped
+				k.debugf("Ignoring provider: %v", err)
+			} else if !seen[rec.Peer.ID] {
+				seen[rec.Peer.ID] = true
+				ret = append(ret, rec.peerInfo())
+			}
+		}
+		return maxCount > 0 && len(ret) >= maxCount
+	}
+	if !addProviders(k.providers.get(target)) {
+		// Only an error if we have nothing to show for it
+		if _, err = k.lookup(ctx, target, addProviders); err != nil && len(ret) > 0 {
+			k.debugf("Lookup failed after finding providers: %v", err)
+			err = nil
+		}
+	}
+	if err == nil && k.verifyProviders != nil {
+		ret = k.liveProviders(ctx, ret)
+	}
+	return ret, err
+}
+
+// Pings each provider with bounded concurrency and returns only the reachable ones, fastest first. Our own node is
+// kept without a ping and sorted last as unmeasured.
+func (k *kadDHT) liveProviders(ctx context.Context, providers []*tordht.PeerInfo) []*tordht.PeerInfo {
+	concurrency, timeout := 3, 1*time.Minute
+	if k.verifyProviders.Concurrency > 0 {
+		concurrency = k.verifyProviders.Concurrency
+	}
+	if k.verifyProviders.Timeout > 0 {
+		timeout = k.verifyProviders.Timeout
+	}
+	sem := make(chan struct{}, concurrency)
+	resultCh := make(chan *tordht.PeerInfo, len(providers))
+	for _, provider := range providers {
+		go func(provider *tordht.PeerInfo) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				resultCh <- nil
+				return
+			}
+			if k.self != nil && provider.ID == k.self.ID {
+				verified := *provider
+				verified.ConnectLatency = tordht.LatencyUnmeasured
+				resultCh <- &verified
+				return
+			}
+			pingCtx, cancelFn := context.WithTimeout(ctx, timeout)
+			defer cancelFn()
+			start := time.Now()
+			if _, err := k.request(pingCtx, provider, &message{Type: messagePing}); err != nil {
+				k.debugf("Provider %v unreachable: %v", provider, err)
+				resultCh <- nil
+			} else {
+				verified := *provider
+				verified.ConnectLatency = time.Since(start)
+				resultCh <- &verified
+			}
+		}(provider)
+	}
+	ret := []*tordht.PeerInfo{}
+	for range providers {
+		if provider := <-resultCh; provider != nil {
+			ret = append(ret, provider)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return fasterProvider(ret[i], ret[j]) })
+	return ret
+}
+
+// Whether a has a lower latency than b, unmeasured last
+func fasterProvider(a *tordht.PeerInfo, b *tordht.PeerInfo) bool {
+	if a.ConnectLatency == tordht.LatencyUnmeasured || b.ConnectLatency == tordht.LatencyUnmeasured {
+		return b.ConnectLatency == tordht.LatencyUnmeasured && a.ConnectLatency != tordht.LatencyUnmeasured
+	}
+	return a.ConnectLatency < b.ConnectLatency
+}
+
+// Pings the peers concurrently, adding the ones that reply to the routing table, until at least minRequired reply
+func (k *kadDHT) pingPeers(ctx context.Context, peers []*tordht.PeerInfo, minRequired int) error {
+	if len(peers) < minRequired {
+		minRequired = len(peers)
+	}
+	k.debugf("Pinging %v peers, waiting for at least %v", len(peers), minRequired)
+	peerErrCh := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer *tordht.PeerInfo) {
+			if id, err := nodeIDFromPeer(peer); err != nil {
+				peerErrCh <- err
+			} else if _, err = k.request(ctx, peer, &message{Type: messagePing}); err != nil {
+				peerErrCh <- fmt.Errorf("Peer connection to %v failed: %v", peer, err)
+			} else {
+				k.table.add(id, peer)
+				peerErrCh <- nil
+			}
+		}(peer)
+	}
+	peerErrs := []error{}
+	peersConnected := 0
+	// Until there is an error or we have enough
+	for {
+		select {
+		case peerErr := <-peerErrCh:
+			if peerErr == nil {
+				if peersConnected++; peersConnected >= minRequired {
+					return nil
+				}
+			} else if peerErrs = append(peerErrs, peerErr); len(peerErrs) > len(peers)-minRequired {
+				return fmt.Errorf("Many failures, unable to get enough peers: %v", peerErrs)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("Context errored with '%v', peer errors: %v", ctx.Err(), peerErrs)
+		}
+	}
+}
+
+// If the context has a trace, sets it up and returns the func to call with the query's error
+func (k *kadDHT) startTrace(ctx context.Context, key string) func(error) {
+	trace := tordht.TraceFromContext(ctx)
+	if trace == nil {
+		return func(error) {}
+	}
+	trace.Key = key
+	trace.Started = time.Now()
+	return func(err error) {
+		trace.Finished = time.Now()
+		if err != nil {
+			trace.Error = err.Error()
+		}
+	}
+}
+
+// Applies the query timeout if there is one
+func (k *kadDHT) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if k.queryTimeout > 0 {
+		return context.WithTimeout(ctx, k.queryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (k *kadDHT) debugf(format string, args ...interface{}) {
+	if k.debug {
+		log.Printf("[DEBUG] [kad] "+format, args...)
+	}
+}
@@ -0,0 +1,9 @@
+package kad
+
+import (
+	"testing"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/tordhttest"
+)
+
+func TestConformance(t *testing.T) { tordhttest.Run(t, Impl) }
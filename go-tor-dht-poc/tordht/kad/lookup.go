@@ -0,0 +1,147 @@
+package kad
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+type lookupCandidate struct {
+	id   nodeID
+	peer *tordht.PeerInfo
+	// Nil if not tracing
+	trace   *tordht.TracePeer
+	hop     int
+	queried bool
+	failed  bool
+}
+
+type lookupResult struct {
+	candidate *lookupCandidate
+	resp      *message
+	err       error
+	queried   time.Time
+	latency   time.Duration
+}
+
+// Iteratively asks the closest known peers to the target for closer ones, alpha at a time, until the closest bucket
+// size worth have all replied. If onProviders is set, get providers requests are sent instead of find node and it is
+// called with the providers of each response, stopping the lookup if it returns true. Returns the closest peers that
+// replied, closest first.
+func (k *kadDHT) lookup(ctx context.Context, target nodeID, onProviders func([]*providerRecord) bool) (
+	[]*tordht.PeerInfo, error) {
+	mesType := messageFindNode
+	if onProviders != nil {
+		mesType = messageGetProviders
+	}
+	trace := tordht.TraceFromContext(ctx)
+	candidates := map[nodeID]*lookupCandidate{}
+	addCandidate := func(id nodeID, peer *tordht.PeerInfo, from *lookupCandidate) {
+		if _, ok := candidates[id]; ok || id == k.selfID {
+			return
+		}
+		c := &lookupCandidate{id: id, peer: peer}
+		if from != nil {
+			c.hop = from.hop + 1
+		}
+		if trace != nil {
+			c.trace = &tordht.TracePeer{ID: peer.ID, Hop: c.hop}
+			if from != nil {
+				c.trace.LearnedFrom = from.peer.ID
+			}
+			trace.Peers = append(trace.Peers, c.trace)
+		}
+		candidates[id] = c
+	}
+	for _, entry := range k.table.closest(target, k.bucketSize) {
+		addCandidate(entry.id, entry.peer, nil)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No peers to query")
+	}
+	// Buffered so the queries never block even if we return early
+	resultCh := make(chan *lookupResult, k.alpha)
+	inFlight := 0
+	for {
+		closest := k.closestCandidates(candidates, target)
+		for _, c := range closest {
+			if inFlight >= k.alpha {
+				break
+			} else if !c.queried {
+				c.queried = true
+				inFlight++
+				go func(c *lookupCandidate) {
+					res := &lookupResult{candidate: c, queried: time.Now()}
+					res.resp, res.err = k.request(ctx, c.peer, &message{Type: mesType, Key: target[:]})
+					res.latency = time.Since(res.queried)
+					resultCh <- res
+				}(c)
+			}
+		}
+		// Done when nothing is left to ask
+		if inFlight == 0 {
+			ret := []*tordht.PeerInfo{}
+			for _, c := range closest {
+				ret = append(ret, c.peer)
+			}
+			return ret, nil
+		}
+		var res *lookupResult
+		select {
+		case res = <-resultCh:
+			inFlight--
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c := res.candidate
+		if c.trace != nil {
+			c.trace.Queried = res.queried
+		}
+		if res.err != nil {
+			k.debugf("Lookup request to %v failed: %v", c.peer, res.err)
+			c.failed = true
+			if k.table.failed(c.id) {
+				k.debugf("Dropped %v from routing table after %v failures", c.peer, maxPeerFailures)
+			}
+			if c.trace != nil {
+				c.trace.Error = res.err.Error()
+			}
+			continue
+		}
+		k.table.add(c.id, c.peer)
+		if c.trace != nil {
+			c.trace.Latency = res.latency
+		}
+		for _, closer := range res.resp.Closer {
+			if closerID, err := nodeIDFromPeer(closer.peerInfo()); err != nil {
+				k.debugf("Ignoring invalid peer from %v: %v", c.peer, err)
+			} else {
+				addCandidate(closerID, closer.peerInfo(), c)
+				if c.trace != nil {
+					c.trace.CloserPeers = append(c.trace.CloserPeers, closer.ID)
+				}
+			}
+		}
+		if onProviders != nil && len(res.resp.Providers) > 0 && onProviders(res.resp.Providers) {
+			return nil, nil
+		}
+	}
+}
+
+// The bucket size worth of closest candidates that haven't failed, closest first
+func (k *kadDHT) closestCandidates(candidates map[nodeID]*lookupCandidate, target nodeID) []*lookupCandidate {
+	ret := []*lookupCandidate{}
+	for _, c := range candidates {
+		if !c.failed {
+			ret = append(ret, c)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return target.closer(ret[i].id, ret[j].id) })
+	if len(ret) > k.bucketSize {
+		ret = ret[:k.bucketSize]
+	}
+	return ret
+}
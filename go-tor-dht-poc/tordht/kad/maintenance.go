@@ -0,0 +1,123 @@
+package kad
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+func (k *kadDHT) Status() *tordht.Status {
+	k.statusLock.Lock()
+	ret := k.status
+	k.statusLock.Unlock()
+	ret.RoutingTableSize = k.table.size()
+	k.connsLock.Lock()
+	// Failed conns are removed, so only the ones not dialed yet are skipped
+	for _, pc := range k.conns {
+		if pc.open {
+			ret.ConnectedPeers++
+		}
+	}
+	k.connsLock.Unlock()
+	return &ret
+}
+
+func (k *kadDHT) Peers() []*tordht.PeerInfo {
+	entries := k.table.entries()
+	ret := make([]*tordht.PeerInfo, len(entries))
+	for i, entry := range entries {
+		ret[i] = entry.peer
+	}
+	return ret
+}
+
+func (k *kadDHT) startMaintenance(conf *tordht.MaintenanceConf) {
+	minSize, checkInterval, refreshInterval := minPeersRequired, 30*time.Second, 5*time.Minute
+	if conf != nil {
+		if conf.MinRoutingTableSize > 0 {
+			minSize = conf.MinRoutingTableSize
+		}
+		if conf.CheckInterval > 0 {
+			checkInterval = conf.CheckInterval
+		}
+		if conf.RefreshInterval > 0 {
+			refreshInterval = conf.RefreshInterval
+		}
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	k.maintenanceCancel = cancelFn
+	k.maintenanceDone = make(chan struct{})
+	go func() {
+		defer close(k.maintenanceDone)
+		checkTicker, refreshTicker := time.NewTicker(checkInterval), time.NewTicker(refreshInterval)
+		defer checkTicker.Stop()
+		defer refreshTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-checkTicker.C:
+				k.checkRoutingTable(ctx, minSize)
+			case <-refreshTicker.C:
+				k.refresh(ctx)
+			}
+		}
+	}()
+}
+
+func (k *kadDHT) stopMaintenance() {
+	if k.maintenanceCancel != nil {
+		k.maintenanceCancel()
+		<-k.maintenanceDone
+		k.maintenanceCancel = nil
+	}
+}
+
+// Re-pings the bootstrap peers when the routing table is too small
+func (k *kadDHT) checkRoutingTable(ctx context.Context, minSize int) {
+	size := k.table.size()
+	if size >= minSize || len(k.bootstrapPeers) == 0 {
+		return
+	}
+	k.debugf("Routing table has %v peers, min is %v, reconnecting", size, minSize)
+	k.statusLock.Lock()
+	k.status.LastReconnect = time.Now()
+	k.status.Reconnects++
+	k.statusLock.Unlock()
+	if err := k.pingPeers(ctx, k.bootstrapPeers, minPeersRequired); err != nil {
+		k.debugf("Failed reconnecting: %v", err)
+		k.setStatusErr(err)
+		return
+	}
+	k.refresh(ctx)
+}
+
+// Looks up ourselves and a random ID to fill the routing table
+func (k *kadDHT) refresh(ctx context.Context) error {
+	k.debugf("Refreshing routing table")
+	ctx, cancelFn := k.queryContext(ctx)
+	defer cancelFn()
+	var random nodeID
+	rand.Read(random[:])
+	_, err := k.lookup(ctx, k.selfID, nil)
+	if err == nil {
+		_, err = k.lookup(ctx, random, nil)
+	}
+	k.statusLock.Lock()
+	k.status.LastRefresh = time.Now()
+	k.statusLock.Unlock()
+	k.setStatusErr(err)
+	return err
+}
+
+func (k *kadDHT) setStatusErr(err error) {
+	k.statusLock.Lock()
+	defer k.statusLock.Unlock()
+	if err == nil {
+		k.status.LastError = ""
+	} else {
+		k.status.LastError = err.Error()
+	}
+}
@@ -0,0 +1,258 @@
+package kad
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// Messages are protobuf wire format, encoded by hand, and prefixed with their varint length. A request and its
+// response have the same type.
+//
+//	message Message {
+//	  uint64 type = 1;
+//	  string protocol = 2;
+//	  bytes key = 3;
+//	  Peer sender = 4;
+//	  repeated Peer closer = 5;
+//	  repeated Provider providers = 6;
+//	  string error = 7;
+//	}
+//	message Peer { string id = 1; string onion = 2; uint64 port = 3; }
+//	message Provider { bytes cid = 1; Peer peer = 2; bytes metadata = 3; uint64 created = 4; bytes signature = 5; }
+type messageType uint64
+
+const (
+	messagePing messageType = iota + 1
+	messageFindNode
+	messageAddProvider
+	messageGetProviders
+)
+
+// Larger messages are rejected
+const maxMessageSize = 1024 * 1024
+
+type message struct {
+	Type     messageType
+	Protocol string
+	// The target node ID for all but ping
+	Key []byte
+	// Nil for client-only nodes
+	Sender    *peerRecord
+	Closer    []*peerRecord
+	Providers []*providerRecord
+	// Only on responses, empty on success
+	Error string
+}
+
+type peerRecord struct {
+	ID             string
+	OnionServiceID string
+	OnionPort      int
+}
+
+func newPeerRecord(info *tordht.PeerInfo) *peerRecord {
+	return &peerRecord{ID: info.ID, OnionServiceID: info.OnionServiceID, OnionPort: info.OnionPort}
+}
+
+func (p *peerRecord) peerInfo() *tordht.PeerInfo {
+	return &tordht.PeerInfo{ID: p.ID, OnionServiceID: p.OnionServiceID, OnionPort: p.OnionPort}
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func writeMessage(w io.Writer, mes *message) error {
+	byts := mes.marshal()
+	if len(byts) > maxMessageSize {
+		return fmt.Errorf("Message of %v bytes is too large", len(byts))
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	prefix = prefix[:binary.PutUvarint(prefix, uint64(len(byts)))]
+	_, err := w.Write(append(prefix, byts...))
+	return err
+}
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	} else if size > maxMessageSize {
+		return nil, fmt.Errorf("Message of %v bytes is too large", size)
+	}
+	byts := make([]byte, size)
+	if _, err = io.ReadFull(r, byts); err != nil {
+		return nil, err
+	}
+	mes := &message{}
+	if err = mes.unmarshal(byts); err != nil {
+		return nil, fmt.Errorf("Invalid message: %v", err)
+	}
+	return mes, nil
+}
+
+func (m *message) marshal() []byte {
+	var b []byte
+	b = encodeVarint(b, 1, uint64(m.Type))
+	b = encodeBytes(b, 2, []byte(m.Protocol))
+	b = encodeBytes(b, 3, m.Key)
+	if m.Sender != nil {
+		b = encodeBytes(b, 4, m.Sender.marshal())
+	}
+	for _, closer := range m.Closer {
+		b = encodeBytes(b, 5, closer.marshal())
+	}
+	for _, provider := range m.Providers {
+		b = encodeBytes(b, 6, provider.marshal())
+	}
+	b = encodeBytes(b, 7, []byte(m.Error))
+	return b
+}
+
+func (m *message) unmarshal(byts []byte) error {
+	return decodeFields(byts, func(field uint64, varint uint64, byts []byte) (err error) {
+		switch field {
+		case 1:
+			m.Type = messageType(varint)
+		case 2:
+			m.Protocol = string(byts)
+		case 3:
+			m.Key = byts
+		case 4:
+			m.Sender = &peerRecord{}
+			err = m.Sender.unmarshal(byts)
+		case 5:
+			closer := &peerRecord{}
+			err = closer.unmarshal(byts)
+			m.Closer = append(m.Closer, closer)
+		case 6:
+			provider := &providerRecord{}
+			err = provider.unmarshal(byts)
+			m.Providers = append(m.Providers, provider)
+		case 7:
+			m.Error = string(byts)
+		}
+		return
+	})
+}
+
+func (p *peerRecord) marshal() []byte {
+	var b []byte
+	b = encodeBytes(b, 1, []byte(p.ID))
+	b = encodeBytes(b, 2, []byte(p.OnionServiceID))
+	b = encodeVarint(b, 3, uint64(p.OnionPort))
+	return b
+}
+
+func (p *peerRecord) unmarshal(byts []byte) error {
+	return decodeFields(byts, func(field uint64, varint uint64, byts []byte) error {
+		switch field {
+		case 1:
+			p.ID = string(byts)
+		case 2:
+			p.OnionServiceID = string(byts)
+		case 3:
+			p.OnionPort = int(varint)
+		}
+		return nil
+	})
+}
+
+func (p *providerRecord) marshal() []byte {
+	var b []byte
+	b = encodeBytes(b, 1, p.CID)
+	if p.Peer != nil {
+		b = encodeBytes(b, 2, p.Peer.marshal())
+	}
+	b = encodeBytes(b, 3, p.Metadata)
+	b = encodeVarint(b, 4, uint64(p.Created))
+	b = encodeBytes(b, 5, p.Signature)
+	return b
+}
+
+func (p *providerRecord) unmarshal(byts []byte) error {
+	return decodeFields(byts, func(field uint64, varint uint64, byts []byte) (err error) {
+		switch field {
+		case 1:
+			p.CID = byts
+		case 2:
+			p.Peer = &peerRecord{}
+			err = p.Peer.unmarshal(byts)
+		case 3:
+			p.Metadata = byts
+		case 4:
+			p.Created = int64(varint)
+		case 5:
+			p.Signature = byts
+		}
+		return
+	})
+}
+
+// Zero values are left off like proto3
+func encodeVarint(b []byte, field uint64, v uint64) []byte {
+	if v != 0 {
+		b = appendUvarint(b, field<<3|wireVarint)
+		b = appendUvarint(b, v)
+	}
+	return b
+}
+
+func encodeBytes(b []byte, field uint64, v []byte) []byte {
+	if len(v) > 0 {
+		b = appendUvarint(b, field<<3|wireBytes)
+		b = appendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	return append(b, varint[:binary.PutUvarint(varint, v)]...)
+}
+
+// Returns the value and the rest of the bytes
+func decodeUvarint(byts []byte) (uint64, []byte, error) {
+	if v, n := binary.Uvarint(byts); n <= 0 {
+		return 0, nil, fmt.Errorf("Invalid varint")
+	} else {
+		return v, byts[n:], nil
+	}
+}
+
+// Calls fn for each field, with either the varint or bytes set depending on the wire type. Unknown fields are given
+// to fn like any other so it must ignore them.
+func decodeFields(byts []byte, fn func(field uint64, varint uint64, byts []byte) error) error {
+	for len(byts) > 0 {
+		tag, rest, err := decodeUvarint(byts)
+		if err != nil {
+			return err
+		}
+		var varint uint64
+		var fieldBytes []byte
+		if wireType := tag & 7; wireType == wireVarint {
+			varint, rest, err = decodeUvarint(rest)
+		} else if wireType != wireBytes {
+			err = fmt.Errorf("Unsupported wire type %v", wireType)
+		} else if size, sizeRest, sizeErr := decodeUvarint(rest); sizeErr != nil {
+			err = sizeErr
+		} else if size > uint64(len(sizeRest)) {
+			err = fmt.Errorf("Field of %v bytes is past the end", size)
+		} else {
+			fieldBytes, rest = sizeRest[:size], sizeRest[size:]
+		}
+		if err != nil {
+			return err
+		} else if err = fn(tag>>3, varint, fieldBytes); err != nil {
+			return err
+		}
+		byts = rest
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package kad
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	cid "github.com/ipfs/go-cid"
+)
+
+// How long a stored provider record lasts without being provided again
+const providerValidity = 24 * time.Hour
+
+// Signed by the provider's onion service key so only the holder of the onion can claim to provide at it
+type providerRecord struct {
+	CID  []byte
+	Peer *peerRecord
+	// Up to tordht.MaxProviderMetadataSize bytes, may be empty
+	Metadata []byte
+	// Unix seconds, the newest record for a peer is kept
+	Created   int64
+	Signature []byte
+}
+
+func newProviderRecord(c cid.Cid, self *tordht.PeerInfo, metadata []byte, key ed25519.KeyPair) *providerRecord {
+	ret := &providerRecord{CID: c.Bytes(), Peer: newPeerRecord(self), Metadata: metadata, Created: time.Now().Unix()}
+	ret.Signature = ed25519.Sign(key, ret.signedBytes())
+	return ret
+}
+
+func (p *providerRecord) signedBytes() []byte {
+	return []byte(fmt.Sprintf("tordht-kad-provider-record\n%x\n%v\n%v:%v\n%v\n%x",
+		p.CID, p.Peer.ID, p.Peer.OnionServiceID, p.Peer.OnionPort, p.Created, p.Metadata))
+}
+
+// Confirms the record is for the target, the peer ID is for the onion, and the signature is from the onion's key
+func (p *providerRecord) verify(target nodeID) error {
+	if p.Peer == nil {
+		return fmt.Errorf("Missing provider peer")
+	} else if keyID(p.CID) != target {
+		return fmt.Errorf("Provider record is for a different key")
+	} else if len(p.Metadata) > tordht.MaxProviderMetadataSize {
+		return fmt.Errorf("Metadata is %v bytes, max is %v", len(p.Metadata), tordht.MaxProviderMetadataSize)
+	} else if _, err := nodeIDFromPeer(p.Peer.peerInfo()); err != nil {
+		return err
+	} else if pubKey, err := torutil.PublicKeyFromV3OnionServiceID(p.Peer.OnionServiceID); err != nil {
+		return fmt.Errorf("Invalid onion %v: %v", p.Peer.OnionServiceID, err)
+	} else if !ed25519.Verify(pubKey, p.signedBytes(), p.Signature) {
+		return fmt.Errorf("Invalid signature for onion %v", p.Peer.OnionServiceID)
+	}
+	return nil
+}
+
+func (p *providerRecord) peerInfo() *tordht.PeerInfo {
+	ret := p.Peer.peerInfo()
+	ret.Metadata = p.Metadata
+	return ret
+}
+
+// Verified provider records stored on this node. Safe for concurrent use.
+type providerStore struct {
+	maxPerPeer int
+
+	lock sync.Mutex
+	// Keyed by target then peer ID
+	records map[nodeID]map[string]*storedProvider
+	// How many records each peer ID has stored
+	peerCounts map[string]int
+	lastPrune  time.Time
+}
+
+type storedProvider struct {
+	record  *providerRecord
+	expires time.Time
+}
+
+func newProviderStore(maxPerPeer int) *providerStore {
+	return &providerStore{
+		maxPerPeer: maxPerPeer,
+		records:    map[nodeID]map[string]*storedProvider{},
+		peerCounts: map[string]int{},
+		lastPrune:  time.Now(),
+	}
+}
+
+// Expects the record to be verified already. Older records than what is stored are ignored.
+func (p *providerStore) add(target nodeID, rec *providerRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prune(time.Now())
+	byPeer := p.records[target]
+	if byPeer == nil {
+		byPeer = map[string]*storedProvider{}
+		p.records[target] = byPeer
+	}
+	existing := byPeer[rec.Peer.ID]
+	if existing != nil && existing.record.Created > rec.Created {
+		return nil
+	} else if existing == nil && p.peerCounts[rec.Peer.ID] >= p.maxPerPeer {
+		return fmt.Errorf("Peer %v is at the max of %v provider records", rec.Peer.ID, p.maxPerPeer)
+	} else if existing == nil {
+		p.peerCounts[rec.Peer.ID]++
+	}
+	byPeer[rec.Peer.ID] = &storedProvider{record: rec, expires: time.Now().Add(providerValidity)}
+	return nil
+}
+
+func (p *providerStore) get(target nodeID) []*providerRecord {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.prune(now)
+	ret := []*providerRecord{}
+	for _, stored := range p.records[target] {
+		if now.Before(stored.expires) {
+			ret = append(ret, stored.record)
+		}
+	}
+	return ret
+}
+
+// Drops expired records at most once a minute. Expects the lock to be held.
+func (p *providerStore) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < time.Minute {
+		return
+	}
+	p.lastPrune = now
+	for target, byPeer := range p.records {
+		for peerID, stored := range byPeer {
+			if now.After(stored.expires) {
+				delete(byPeer, peerID)
+				if p.peerCounts[peerID]--; p.peerCounts[peerID] <= 0 {
+					delete(p.peerCounts, peerID)
+				}
+			}
+		}
+		if len(byPeer) == 0 {
+			delete(p.records, target)
+		}
+	}
+}
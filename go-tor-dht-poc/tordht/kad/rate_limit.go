@@ -0,0 +1,55 @@
+package kad
+
+import (
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// Inbound conns over Tor don't say who opened them, so requests are limited per conn instead of per peer. Nil if
+// limits are disabled.
+type requestLimit struct {
+	rate  float64
+	burst float64
+}
+
+func newRequestLimit(conf *tordht.RateLimitConf) *requestLimit {
+	ret := &requestLimit{rate: 10, burst: 50}
+	if conf != nil {
+		if conf.Disabled {
+			return nil
+		}
+		if conf.RequestsPerSecond > 0 {
+			ret.rate = conf.RequestsPerSecond
+		}
+		if conf.Burst > 0 {
+			ret.burst = float64(conf.Burst)
+		}
+	}
+	return ret
+}
+
+func (r *requestLimit) newBucket() *tokenBucket {
+	if r == nil {
+		return nil
+	}
+	return &tokenBucket{tokens: r.burst, last: time.Now()}
+}
+
+// Not safe for concurrent use, each inbound conn has its own
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	if t.tokens += now.Sub(t.last).Seconds() * rate; t.tokens > burst {
+		t.tokens = burst
+	}
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
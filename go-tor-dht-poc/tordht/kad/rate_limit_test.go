@@ -0,0 +1,52 @@
+package kad
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/tordhttest"
+)
+
+func TestInboundRequestLimit(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), tordhttest.TestTimeout)
+	defer cancelFn()
+	network := tordhttest.NewMemoryNetwork()
+	node, err := Impl.NewDHT(ctx, &tordht.DHTConf{
+		Network:   network,
+		RateLimit: &tordht.RateLimitConf{RequestsPerSecond: 0.001, Burst: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	conn, err := network.Dial(ctx, node.PeerInfo().OnionServiceID, node.PeerInfo().OnionPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		if err := writeMessage(conn, &message{Type: messagePing, Protocol: ProtocolID}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readMessage(reader)
+		if err != nil {
+			t.Fatal(err)
+		} else if i < 2 && resp.Error != "" {
+			t.Fatalf("Expected ping #%v to succeed, got: %v", i+1, resp.Error)
+		} else if i == 2 && resp.Error == "" {
+			t.Fatal("Expected ping over the burst to fail")
+		}
+	}
+	if _, err := readMessage(reader); err == nil {
+		t.Fatal("Expected conn to be closed after the limit")
+	}
+	if status := node.Status(); status.RateLimitedRequests != 1 || status.ConnectedPeers != 0 {
+		t.Fatalf("Expected 1 rate limited request and no connected peers, got %v and %v",
+			status.RateLimitedRequests, status.ConnectedPeers)
+	}
+}
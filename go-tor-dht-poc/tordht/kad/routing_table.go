@@ -0,0 +1,174 @@
+package kad
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// A point in the 256-bit key space. Node IDs are the hash of their onion's public key so they can't be chosen freely,
+// keys are the hash of the CID.
+type nodeID [32]byte
+
+func nodeIDFromOnion(onionID string) (nodeID, error) {
+	pubKey, err := torutil.PublicKeyFromV3OnionServiceID(onionID)
+	if err != nil {
+		return nodeID{}, fmt.Errorf("Invalid onion %v: %v", onionID, err)
+	}
+	return sha256.Sum256(pubKey), nil
+}
+
+// Confirms the peer's ID is for its onion
+func nodeIDFromPeer(info *tordht.PeerInfo) (nodeID, error) {
+	if id, err := nodeIDFromOnion(info.OnionServiceID); err != nil {
+		return nodeID{}, err
+	} else if id.String() != info.ID {
+		return nodeID{}, fmt.Errorf("Peer ID %v is not for onion %v", info.ID, info.OnionServiceID)
+	} else {
+		return id, nil
+	}
+}
+
+func keyID(key []byte) nodeID { return sha256.Sum256(key) }
+
+func (n nodeID) String() string { return hex.EncodeToString(n[:]) }
+
+// The bucket index, i.e. the number of leading bits in common
+func (n nodeID) commonPrefixLen(other nodeID) int {
+	for i := range n {
+		if x := n[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(n) * 8
+}
+
+// Whether a is closer than b to n
+func (n nodeID) closer(a nodeID, b nodeID) bool {
+	var distA, distB nodeID
+	for i := range n {
+		distA[i], distB[i] = n[i]^a[i], n[i]^b[i]
+	}
+	return bytes.Compare(distA[:], distB[:]) < 0
+}
+
+// Buckets of peers by how many leading bits they share with us. Safe for concurrent use.
+type routingTable struct {
+	self       nodeID
+	bucketSize int
+
+	lock sync.Mutex
+	// Least recently seen first
+	buckets [256][]*tableEntry
+}
+
+type tableEntry struct {
+	id   nodeID
+	peer *tordht.PeerInfo
+	// Failed requests since the peer was last seen
+	failures int
+}
+
+// How many requests in a row can fail before a peer is dropped. Onion circuits fail now and then, one failure doesn't
+// mean the peer is gone.
+const maxPeerFailures = 3
+
+func newRoutingTable(self nodeID, bucketSize int) *routingTable {
+	return &routingTable{self: self, bucketSize: bucketSize}
+}
+
+// Moves the peer to the end of its bucket, adding it if there is room. Like Kademlia, long lived peers are preferred
+// over new ones so the peer is dropped if the bucket is full. Returns whether the peer is in the table.
+func (r *routingTable) add(id nodeID, peer *tordht.PeerInfo) bool {
+	if id == r.self {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	bucket := r.bucket(id)
+	for i, entry := range *bucket {
+		if entry.id == id {
+			*bucket = append(append((*bucket)[:i], (*bucket)[i+1:]...), &tableEntry{id: id, peer: peer})
+			return true
+		}
+	}
+	if len(*bucket) >= r.bucketSize {
+		return false
+	}
+	*bucket = append(*bucket, &tableEntry{id: id, peer: peer})
+	return true
+}
+
+// Records a failed request to the peer, dropping it after maxPeerFailures in a row. Returns whether it was dropped.
+func (r *routingTable) failed(id nodeID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	bucket := r.bucket(id)
+	for i, entry := range *bucket {
+		if entry.id != id {
+			continue
+		} else if entry.failures++; entry.failures < maxPeerFailures {
+			return false
+		}
+		*bucket = append((*bucket)[:i], (*bucket)[i+1:]...)
+		return true
+	}
+	return false
+}
+
+func (r *routingTable) contains(id nodeID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, entry := range *r.bucket(id) {
+		if entry.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Expects the lock to be held
+func (r *routingTable) bucket(id nodeID) *[]*tableEntry {
+	index := r.self.commonPrefixLen(id)
+	if index >= len(r.buckets) {
+		index = len(r.buckets) - 1
+	}
+	return &r.buckets[index]
+}
+
+// The count closest peers to the target, closest first
+func (r *routingTable) closest(target nodeID, count int) []*tableEntry {
+	ret := r.entries()
+	sort.Slice(ret, func(i, j int) bool { return target.closer(ret[i].id, ret[j].id) })
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+	return ret
+}
+
+func (r *routingTable) entries() []*tableEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := []*tableEntry{}
+	for _, bucket := range r.buckets {
+		ret = append(ret, bucket...)
+	}
+	return ret
+}
+
+func (r *routingTable) size() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := 0
+	for _, bucket := range r.buckets {
+		ret += len(bucket)
+	}
+	return ret
+}
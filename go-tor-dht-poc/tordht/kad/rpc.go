@@ -0,0 +1,257 @@
+package kad
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// How long a request waits for its response if the context has no deadline
+const requestTimeout = 2 * time.Minute
+
+// How long an inbound conn can go without a request before it is closed
+const inboundIdleTimeout = 5 * time.Minute
+
+// Most peers heard from that are pinged at once before being added to the routing table
+const maxLearningPeers = 16
+
+var errClosed = errors.New("DHT is closed")
+
+// An outbound conn to a peer. Requests on it are sent one at a time.
+type peerConn struct {
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	// Set by Close, a request that got the peerConn before Close may get the lock after it
+	closed bool
+	// Set once dialed, guarded by the DHT's connsLock instead so Status doesn't wait on a request
+	open bool
+}
+
+// Sends the request to the peer and returns the response. A conn is kept open to each peer for reuse.
+func (k *kadDHT) request(ctx context.Context, peer *tordht.PeerInfo, req *message) (*message, error) {
+	req.Protocol = k.protocolID
+	if k.self != nil {
+		req.Sender = newPeerRecord(k.self)
+	}
+	pc, err := k.peerConn(peer)
+	if err != nil {
+		return nil, err
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.closed {
+		return nil, errClosed
+	} else if pc.conn == nil {
+		conn, err := k.network.Dial(ctx, peer.OnionServiceID, peer.OnionPort)
+		if err != nil {
+			k.removePeerConn(peer, pc)
+			return nil, fmt.Errorf("Failed dialing %v: %v", peer, err)
+		}
+		pc.conn, pc.reader = conn, bufio.NewReader(conn)
+		k.connsLock.Lock()
+		pc.open = true
+		k.connsLock.Unlock()
+	}
+	resp, err := pc.roundTrip(ctx, req)
+	if err != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		k.removePeerConn(peer, pc)
+		return nil, err
+	} else if resp.Type != req.Type {
+		return nil, fmt.Errorf("Expected response type %v, got %v", req.Type, resp.Type)
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("Peer %v failed request: %v", peer, resp.Error)
+	}
+	return resp, nil
+}
+
+// Expects the lock to be held
+func (p *peerConn) roundTrip(ctx context.Context, req *message) (*message, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(requestTimeout)
+	}
+	// The field is cleared once the lock is released, the goroutine may still be running then
+	conn := p.conn
+	conn.SetDeadline(deadline)
+	// Cancelling the context expires the deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if err := writeMessage(conn, req); err != nil {
+		return nil, err
+	}
+	return readMessage(p.reader)
+}
+
+// Fails once closed so no conns are opened that Close won't see
+func (k *kadDHT) peerConn(peer *tordht.PeerInfo) (*peerConn, error) {
+	k.connsLock.Lock()
+	defer k.connsLock.Unlock()
+	if k.closed {
+		return nil, errClosed
+	}
+	key := peerConnKey(peer)
+	pc := k.conns[key]
+	if pc == nil {
+		pc = &peerConn{}
+		k.conns[key] = pc
+	}
+	return pc, nil
+}
+
+// Only removes it if it's still the one for the peer
+func (k *kadDHT) removePeerConn(peer *tordht.PeerInfo, pc *peerConn) {
+	k.connsLock.Lock()
+	defer k.connsLock.Unlock()
+	if key := peerConnKey(peer); k.conns[key] == pc {
+		delete(k.conns, key)
+	}
+}
+
+// Not PeerInfo.String since the impl isn't always known
+func peerConnKey(peer *tordht.PeerInfo) string {
+	return fmt.Sprintf("%v:%v/%v", peer.OnionServiceID, peer.OnionPort, peer.ID)
+}
+
+// Accepts conns until the listener is closed
+func (k *kadDHT) serve() {
+	defer close(k.serveDone)
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			k.debugf("Stopped accepting: %v", err)
+			return
+		}
+		go k.serveConn(conn)
+	}
+}
+
+func (k *kadDHT) serveConn(conn net.Conn) {
+	k.connsLock.Lock()
+	if k.closed {
+		k.connsLock.Unlock()
+		conn.Close()
+		return
+	}
+	k.inbound[conn] = struct{}{}
+	k.connsLock.Unlock()
+	defer func() {
+		k.connsLock.Lock()
+		delete(k.inbound, conn)
+		k.connsLock.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	bucket := k.requestLimit.newBucket()
+	for {
+		conn.SetDeadline(time.Now().Add(inboundIdleTimeout))
+		req, err := readMessage(reader)
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		// Over the limit, the conn is closed after the error is sent
+		if bucket != nil && !bucket.take(time.Now(), k.requestLimit.rate, k.requestLimit.burst) {
+			k.statusLock.Lock()
+			k.status.RateLimitedRequests++
+			k.statusLock.Unlock()
+			writeMessage(conn, &message{Type: req.Type, Protocol: k.protocolID, Error: "Over the rate limit"})
+			return
+		}
+		if err = writeMessage(conn, k.handle(req)); err != nil {
+			return
+		}
+	}
+}
+
+func (k *kadDHT) handle(req *message) *message {
+	resp := &message{Type: req.Type, Protocol: k.protocolID}
+	if k.self != nil {
+		resp.Sender = newPeerRecord(k.self)
+	}
+	if req.Protocol != k.protocolID {
+		resp.Error = fmt.Sprintf("Unsupported protocol '%v'", req.Protocol)
+		return resp
+	} else if req.Type != messagePing && len(req.Key) != len(nodeID{}) {
+		resp.Error = "Invalid key"
+		return resp
+	}
+	if req.Sender != nil {
+		k.learnPeer(req.Sender.peerInfo())
+	}
+	var target nodeID
+	copy(target[:], req.Key)
+	switch req.Type {
+	case messagePing:
+	case messageFindNode:
+		resp.Closer = k.closerRecords(target)
+	case messageAddProvider:
+		for _, rec := range req.Providers {
+			if err := rec.verify(target); err != nil {
+				resp.Error = err.Error()
+			} else if err = k.providers.add(target, rec); err != nil {
+				resp.Error = err.Error()
+			}
+		}
+	case messageGetProviders:
+		resp.Providers = k.providers.get(target)
+		resp.Closer = k.closerRecords(target)
+	default:
+		resp.Error = fmt.Sprintf("Unknown message type %v", req.Type)
+	}
+	return resp
+}
+
+func (k *kadDHT) closerRecords(target nodeID) []*peerRecord {
+	ret := []*peerRecord{}
+	for _, entry := range k.table.closest(target, k.bucketSize) {
+		ret = append(ret, newPeerRecord(entry.peer))
+	}
+	return ret
+}
+
+// Pings a peer we heard from that isn't in the routing table, adding it if it replies. This way only peers that are
+// really reachable at their onion get added. Senders aren't authenticated, so at most maxLearningPeers are pinged at
+// once and the rest are dropped.
+func (k *kadDHT) learnPeer(peer *tordht.PeerInfo) {
+	id, err := nodeIDFromPeer(peer)
+	if err != nil || k.table.contains(id) {
+		return
+	}
+	k.connsLock.Lock()
+	if k.closed || k.learning[id] || len(k.learning) >= maxLearningPeers {
+		k.connsLock.Unlock()
+		return
+	}
+	k.learning[id] = true
+	k.connsLock.Unlock()
+	go func() {
+		defer func() {
+			k.connsLock.Lock()
+			delete(k.learning, id)
+			k.connsLock.Unlock()
+		}()
+		ctx, cancelFn := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancelFn()
+		if _, err := k.request(ctx, peer, &message{Type: messagePing}); err != nil {
+			k.debugf("Not adding peer %v, ping failed: %v", peer, err)
+		} else {
+			k.table.add(id, peer)
+		}
+	}()
+}
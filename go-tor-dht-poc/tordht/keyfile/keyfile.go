@@ -0,0 +1,294 @@
+// Package keyfile reads and writes a node's long-term keys, the v3 onion service key and the libp2p peer key, as PEM
+// files that are optionally encrypted with a passphrase.
+package keyfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	stded25519 "golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The PEM block types. The onion key block is the same as the js web server's onion.pem so those files are identity
+// files with only an onion key.
+const (
+	OnionKeyBlockType = "PRIVATE KEY"
+	PeerKeyBlockType  = "LIBP2P PRIVATE KEY"
+)
+
+// The only encryption there is, given in the Encryption header of encrypted blocks
+const encryptionScryptAESGCM = "scrypt-aes-256-gcm"
+
+// ErrPassphraseRequired is returned when decoding encrypted keys without a passphrase.
+var ErrPassphraseRequired = errors.New("Key file is encrypted, passphrase required")
+
+// Identity is a node's long-term keys. Either can be nil/empty.
+type Identity struct {
+	// The v3 onion service key, for tordht.DHTConf.OnionKey. Nil for onion identities, the onion key is derived from
+	// the peer key then.
+	OnionKey ed25519.KeyPair
+	// The libp2p marshaled private key, for tordht.DHTConf.PeerKey
+	PeerKey []byte
+}
+
+// OnionIdentity is true if there is only an Ed25519 peer key to derive the onion key from, for
+// tordht.DHTConf.OnionIdentity.
+func (i *Identity) OnionIdentity() bool { return i.OnionKey == nil && len(i.PeerKey) > 0 }
+
+// OnionServiceKey is the onion key, derived from the Ed25519 peer key for onion identities the same way the ipfs impl
+// does.
+func (i *Identity) OnionServiceKey() (ed25519.KeyPair, error) {
+	if i.OnionKey != nil {
+		return i.OnionKey, nil
+	} else if privKey, err := crypto.UnmarshalPrivateKey(i.PeerKey); err != nil {
+		return nil, fmt.Errorf("Invalid peer key: %v", err)
+	} else if _, ok := privKey.(*crypto.Ed25519PrivateKey); !ok {
+		return nil, fmt.Errorf("Peer key must be Ed25519 for onion identity")
+	} else if raw, err := privKey.Raw(); err != nil {
+		return nil, fmt.Errorf("Failed reading peer key: %v", err)
+	} else {
+		return ed25519.FromCryptoPrivateKey(stded25519.PrivateKey(raw)), nil
+	}
+}
+
+// Generate creates a random identity. If onionIdentity is true, only the peer key is created. The peer key is always
+// Ed25519.
+func Generate(onionIdentity bool) (*Identity, error) {
+	ret := &Identity{}
+	if peerKey, err := GeneratePeerKey(); err != nil {
+		return nil, err
+	} else {
+		ret.PeerKey = peerKey
+	}
+	if !onionIdentity {
+		if onionKey, err := ed25519.GenerateKey(nil); err != nil {
+			return nil, fmt.Errorf("Failed generating onion key: %v", err)
+		} else {
+			ret.OnionKey = onionKey
+		}
+	}
+	return ret, nil
+}
+
+// GeneratePeerKey creates a random libp2p marshaled Ed25519 private key.
+func GeneratePeerKey() ([]byte, error) {
+	if key, _, err := crypto.GenerateEd25519Key(rand.Reader); err != nil {
+		return nil, fmt.Errorf("Failed generating peer key: %v", err)
+	} else if byts, err := crypto.MarshalPrivateKey(key); err != nil {
+		return nil, fmt.Errorf("Failed marshaling peer key: %v", err)
+	} else {
+		return byts, nil
+	}
+}
+
+// Encode returns the PEM blocks of the keys. If the passphrase is not empty, the blocks are encrypted with it.
+func Encode(id *Identity, passphrase []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	encode := func(blockType string, key []byte) error {
+		block := &pem.Block{Type: blockType, Bytes: key}
+		if len(passphrase) > 0 {
+			if err := encrypt(block, passphrase); err != nil {
+				return err
+			}
+		}
+		return pem.Encode(&buf, block)
+	}
+	if id.OnionKey != nil {
+		if err := encode(OnionKeyBlockType, id.OnionKey.PrivateKey()); err != nil {
+			return nil, err
+		}
+	}
+	if len(id.PeerKey) > 0 {
+		if err := encode(PeerKeyBlockType, id.PeerKey); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode parses the PEM blocks of Encode. The passphrase is only needed if they are encrypted.
+func Decode(byts []byte, passphrase []byte) (*Identity, error) {
+	ret := &Identity{}
+	for {
+		var block *pem.Block
+		if block, byts = pem.Decode(byts); block == nil {
+			break
+		} else if err := decrypt(block, passphrase); err != nil {
+			return nil, err
+		} else if block.Type == OnionKeyBlockType && ret.OnionKey == nil {
+			if len(block.Bytes) != 64 {
+				return nil, fmt.Errorf("Expected 64 byte onion key, got %v", len(block.Bytes))
+			}
+			ret.OnionKey = ed25519.PrivateKey(block.Bytes).KeyPair()
+		} else if block.Type == PeerKeyBlockType && len(ret.PeerKey) == 0 {
+			if _, err := crypto.UnmarshalPrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("Invalid peer key: %v", err)
+			}
+			ret.PeerKey = block.Bytes
+		} else {
+			return nil, fmt.Errorf("Unexpected or duplicate PEM block '%v'", block.Type)
+		}
+	}
+	if ret.OnionKey == nil && len(ret.PeerKey) == 0 {
+		return nil, fmt.Errorf("No keys found")
+	}
+	return ret, nil
+}
+
+// IsEncrypted is true if any of the PEM blocks are encrypted.
+func IsEncrypted(byts []byte) bool {
+	for {
+		var block *pem.Block
+		if block, byts = pem.Decode(byts); block == nil {
+			return false
+		} else if block.Headers["Encryption"] != "" {
+			return true
+		}
+	}
+}
+
+// Load reads the identity from the file. The passphrase is only needed if it's encrypted.
+func Load(file string, passphrase []byte) (*Identity, error) {
+	if byts, err := ioutil.ReadFile(file); err != nil {
+		return nil, err
+	} else if id, err := Decode(byts, passphrase); err != nil {
+		return nil, fmt.Errorf("Failed reading %v: %v", file, err)
+	} else {
+		return id, nil
+	}
+}
+
+// Save writes the identity to the file only the current user can read, encrypting it if the passphrase is not empty.
+// The file is written to a temporary file first so an existing one is never left half written.
+func Save(file string, id *Identity, passphrase []byte) error {
+	byts, err := Encode(id, passphrase)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Failed creating temp file: %v", err)
+	}
+	_, err = tmpFile.Write(byts)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Failed writing %v: %v", file, err)
+	}
+	return nil
+}
+
+// LoadOrCreateOnionKey loads the onion key from the unencrypted file, or creates the file with a random one if it
+// doesn't exist.
+func LoadOrCreateOnionKey(file string) (ed25519.KeyPair, error) {
+	if id, err := Load(file, nil); err == nil {
+		if id.OnionKey == nil {
+			return nil, fmt.Errorf("No onion key in %v", file)
+		}
+		return id.OnionKey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if key, err := ed25519.GenerateKey(nil); err != nil {
+		return nil, fmt.Errorf("Failed generating key: %v", err)
+	} else {
+		return key, Save(file, &Identity{OnionKey: key}, nil)
+	}
+}
+
+// Tor's hs_ed25519_secret_key files are this 32 byte header then the 64 byte expanded key
+var torSecretKeyHeader = append([]byte("== ed25519v1-secret: type0 =="), 0, 0, 0)
+
+// EncodeTorSecretKey returns the onion key in Tor's hs_ed25519_secret_key file format.
+func EncodeTorSecretKey(key ed25519.KeyPair) []byte {
+	return append(append([]byte{}, torSecretKeyHeader...), key.PrivateKey()...)
+}
+
+// DecodeTorSecretKey parses Tor's hs_ed25519_secret_key file format.
+func DecodeTorSecretKey(byts []byte) (ed25519.KeyPair, error) {
+	if len(byts) != len(torSecretKeyHeader)+64 || !bytes.HasPrefix(byts, torSecretKeyHeader) {
+		return nil, fmt.Errorf("Not a Tor hs_ed25519_secret_key file")
+	}
+	return ed25519.PrivateKey(append([]byte{}, byts[len(torSecretKeyHeader):]...)).KeyPair(), nil
+}
+
+func encrypt(block *pem.Block, passphrase []byte) error {
+	salt, nonce := make([]byte, 16), make([]byte, 12)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("Failed generating salt: %v", err)
+	} else if _, err = rand.Read(nonce); err != nil {
+		return fmt.Errorf("Failed generating nonce: %v", err)
+	}
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	block.Headers = map[string]string{
+		"Encryption": encryptionScryptAESGCM,
+		"Salt":       base64.StdEncoding.EncodeToString(salt),
+		"Nonce":      base64.StdEncoding.EncodeToString(nonce),
+	}
+	// The block type is authenticated so blocks can't be swapped
+	block.Bytes = gcm.Seal(nil, nonce, block.Bytes, []byte(block.Type))
+	return nil
+}
+
+// Does nothing if the block isn't encrypted
+func decrypt(block *pem.Block, passphrase []byte) error {
+	if block.Headers["Encryption"] == "" {
+		return nil
+	} else if block.Headers["Encryption"] != encryptionScryptAESGCM {
+		return fmt.Errorf("Unknown encryption '%v'", block.Headers["Encryption"])
+	} else if len(passphrase) == 0 {
+		return ErrPassphraseRequired
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return fmt.Errorf("Invalid salt: %v", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return fmt.Errorf("Invalid nonce: %v", err)
+	}
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return err
+	} else if len(nonce) != gcm.NonceSize() {
+		return fmt.Errorf("Invalid nonce size")
+	} else if block.Bytes, err = gcm.Open(nil, nonce, block.Bytes, []byte(block.Type)); err != nil {
+		return fmt.Errorf("Failed decrypting, wrong passphrase?")
+	}
+	block.Headers = nil
+	return nil
+}
+
+func passphraseCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Failed deriving key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
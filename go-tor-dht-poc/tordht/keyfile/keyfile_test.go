@@ -0,0 +1,128 @@
+package keyfile
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+func testIdentity(t *testing.T) *Identity {
+	id, err := Generate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func assertSameIdentity(t *testing.T, expected *Identity, actual *Identity) {
+	if !bytes.Equal(expected.OnionKey.PrivateKey(), actual.OnionKey.PrivateKey()) {
+		t.Fatal("Onion keys differ")
+	} else if !bytes.Equal(expected.PeerKey, actual.PeerKey) {
+		t.Fatal("Peer keys differ")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	id := testIdentity(t)
+	for _, passphrase := range [][]byte{nil, []byte("secret")} {
+		byts, err := Encode(id, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		} else if IsEncrypted(byts) != (passphrase != nil) {
+			t.Fatalf("Expected encrypted to be %v", passphrase != nil)
+		}
+		actual, err := Decode(byts, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameIdentity(t, id, actual)
+	}
+	// Onion identities only have the peer key
+	onionID, err := Generate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byts, err := Encode(onionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if actual, err := Decode(byts, nil); err != nil {
+		t.Fatal(err)
+	} else if !actual.OnionIdentity() || !bytes.Equal(actual.PeerKey, onionID.PeerKey) {
+		t.Fatal("Expected same onion identity")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	byts, err := Encode(testIdentity(t), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Decode(byts, nil); err != ErrPassphraseRequired {
+		t.Fatalf("Expected passphrase required, got: %v", err)
+	} else if _, err = Decode(byts, []byte("wrong")); err == nil {
+		t.Fatal("Expected wrong passphrase to fail")
+	}
+}
+
+func TestSwappedBlockType(t *testing.T) {
+	byts, err := Encode(&Identity{OnionKey: testIdentity(t).OnionKey}, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The block type is authenticated, so relabeling the onion key as a peer key has to fail decryption
+	block, _ := pem.Decode(byts)
+	block.Type = PeerKeyBlockType
+	if _, err = Decode(pem.EncodeToMemory(block), []byte("secret")); err == nil {
+		t.Fatal("Expected swapped block type to fail")
+	}
+}
+
+func TestTorSecretKeyRoundTrip(t *testing.T) {
+	key := testIdentity(t).OnionKey
+	byts := EncodeTorSecretKey(key)
+	if len(byts) != 96 {
+		t.Fatalf("Expected 96 bytes, got %v", len(byts))
+	}
+	actual, err := DecodeTorSecretKey(byts)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(key.PrivateKey(), actual.PrivateKey()) {
+		t.Fatal("Keys differ")
+	}
+	if _, err = DecodeTorSecretKey(byts[1:]); err == nil {
+		t.Fatal("Expected truncated key to fail")
+	}
+}
+
+func TestLoadJSOnionPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Written the same way the js web server wrote onion.pem before this package existed
+	key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "onion.pem")
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: key.PrivateKey()}
+	if err = ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := Load(file, nil); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(key.PrivateKey(), id.OnionKey.PrivateKey()) || len(id.PeerKey) != 0 {
+		t.Fatal("Expected only the same onion key")
+	}
+	if loaded, err := LoadOrCreateOnionKey(file); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(key.PrivateKey(), loaded.PrivateKey()) {
+		t.Fatal("Expected the existing onion key")
+	}
+}
@@ -0,0 +1,80 @@
+package tordht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// OnionNetwork is how implementations dial and listen on onion services. Every implementation reaches peers only
+// through it so it can be swapped, e.g. for an in-memory network.
+type OnionNetwork interface {
+	// Dial connects to the port on the onion service. The ID does not have the ".onion" suffix.
+	Dial(ctx context.Context, onionServiceID string, port int) (net.Conn, error)
+	// Listen creates an onion service for the key
+	Listen(ctx context.Context, key ed25519.KeyPair) (OnionListener, error)
+}
+
+// OnionListener accepts connections to an onion service. Closing it removes the onion service.
+type OnionListener interface {
+	net.Listener
+	OnionServiceID() string
+	OnionPort() int
+}
+
+type torNetwork struct {
+	tor      *tor.Tor
+	dialConf *tor.DialConf
+
+	dialerLock sync.Mutex
+	dialer     *tor.Dialer
+}
+
+// NewTorNetwork creates an OnionNetwork over a running Tor. The dial conf may be nil.
+func NewTorNetwork(t *tor.Tor, dialConf *tor.DialConf) OnionNetwork {
+	return &torNetwork{tor: t, dialConf: dialConf}
+}
+
+func (t *torNetwork) Dial(ctx context.Context, onionServiceID string, port int) (net.Conn, error) {
+	dialer, err := t.initDialer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, "tcp", fmt.Sprintf("%v.onion:%v", onionServiceID, port))
+}
+
+func (t *torNetwork) initDialer(ctx context.Context) (*tor.Dialer, error) {
+	t.dialerLock.Lock()
+	defer t.dialerLock.Unlock()
+	// If already inited, good enough
+	if t.dialer == nil {
+		var err error
+		if t.dialer, err = t.tor.Dialer(ctx, t.dialConf); err != nil {
+			return nil, fmt.Errorf("Failed creating tor dialer: %v", err)
+		}
+	}
+	return t.dialer, nil
+}
+
+func (t *torNetwork) Listen(ctx context.Context, key ed25519.KeyPair) (OnionListener, error) {
+	// Version 3 on a random port
+	onion, err := t.tor.Listen(ctx, &tor.ListenConf{Version3: true, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return &torOnionListener{onion: onion}, nil
+}
+
+type torOnionListener struct {
+	onion *tor.OnionService
+}
+
+func (t *torOnionListener) Accept() (net.Conn, error) { return t.onion.Accept() }
+func (t *torOnionListener) Close() error              { return t.onion.Close() }
+func (t *torOnionListener) Addr() net.Addr            { return t.onion }
+func (t *torOnionListener) OnionServiceID() string    { return t.onion.ID }
+func (t *torOnionListener) OnionPort() int            { return t.onion.RemotePorts[0] }
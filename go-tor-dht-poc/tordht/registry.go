@@ -0,0 +1,64 @@
+package tordht
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var implsLock sync.Mutex
+var impls = map[string]Impl{}
+
+// Register makes the impl available by its name. Implementations call it from init. It panics if the name is taken.
+func Register(impl Impl) {
+	implsLock.Lock()
+	defer implsLock.Unlock()
+	if _, ok := impls[impl.Name()]; ok {
+		panic(fmt.Sprintf("Implementation %v already registered", impl.Name()))
+	}
+	impls[impl.Name()] = impl
+}
+
+// ImplByName returns the registered impl with the name.
+func ImplByName(name string) (Impl, error) {
+	implsLock.Lock()
+	defer implsLock.Unlock()
+	if impl, ok := impls[name]; ok {
+		return impl, nil
+	}
+	return nil, fmt.Errorf("Unknown implementation '%v'", name)
+}
+
+// ImplNames returns the names of all registered impls, sorted.
+func ImplNames() []string {
+	implsLock.Lock()
+	defer implsLock.Unlock()
+	ret := make([]string, 0, len(impls))
+	for name := range impls {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// CheckImpl errors if the peer is known to be running a different implementation or an incompatible major version.
+// Peers without an implementation set pass.
+func (p *PeerInfo) CheckImpl(impl Impl) error {
+	if p.Impl == "" {
+		return nil
+	} else if p.Impl != impl.Name() {
+		return fmt.Errorf("Peer %v is running implementation %v, this is %v", p, p.Impl, impl.Name())
+	} else if majorVersion(p.ImplVersion) != majorVersion(impl.Version()) {
+		return fmt.Errorf("Peer %v is running %v version %v, this is incompatible version %v",
+			p, p.Impl, p.ImplVersion, impl.Version())
+	}
+	return nil
+}
+
+func majorVersion(version string) string {
+	if dot := strings.IndexByte(version, '.'); dot >= 0 {
+		return version[:dot]
+	}
+	return version
+}
@@ -0,0 +1,16 @@
+package tordht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewSwarmKey generates a random pre-shared key in the standard swarm.key file format for use as DHTConf.SwarmKey.
+func NewSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Failed generating swarm key: %v", err)
+	}
+	return []byte("/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n"), nil
+}
@@ -5,52 +5,301 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	cid "github.com/ipfs/go-cid"
+	multihash "github.com/multiformats/go-multihash"
 
 	"github.com/cretz/bine/tor"
 )
 
 type Impl interface {
+	// Name is the unique name the impl is registered under
+	Name() string
+	// Version is the impl's version. Peers with different major versions can't talk to each other.
+	Version() string
 	ApplyDebugLogging()
-	RawStringDataID(id []byte) (string, error)
+	// RawStringDataID returns the DHT key for the ID as other clients would compute it. The conf may be nil for
+	// defaults.
+	RawStringDataID(id []byte, conf *DataIDConf) (string, error)
 	NewDHT(ctx context.Context, conf *DHTConf) (DHT, error)
+	// Capabilities are the optional features the impl supports
+	Capabilities() Capabilities
+	// IdentityPeerInfo returns the PeerInfo a non-client-only DHT with the conf's OnionKey, PeerKey, and OnionIdentity
+	// would have, without starting it. The OnionPort is 0 since it's only known once listening. Keys that would be
+	// generated on start are required.
+	IdentityPeerInfo(conf *DHTConf) (*PeerInfo, error)
+}
+
+// Capabilities are optional features an Impl may support. DHTConf fields for unsupported ones make NewDHT fail.
+type Capabilities struct {
+	// DHTConf.I2P
+	I2P bool
+	// DHTConf.SwarmKey
+	SwarmKey bool
+	// DHTConf.PeerCacheFile
+	PeerCache bool
+	// Whether the browser client can join the DHT
+	Browser bool
 }
 
 type DHTConf struct {
-	Tor            *tor.Tor
+	// Used for the onion network if Network is nil. May be nil if Network or I2P is set.
+	Tor *tor.Tor
+	// If set, used to dial and listen on onion services instead of Tor
+	Network OnionNetwork
+	// If set, I2P is used in addition to Tor (or instead of it if Tor is nil)
+	I2P            *I2PConf
 	BootstrapPeers []*PeerInfo
-	ClientOnly     bool
-	Verbose        bool
+	// If set, good peers are saved to this file and used as bootstrap candidates on the next start. They are best
+	// effort, only unreachable BootstrapPeers fail NewDHT.
+	PeerCacheFile string
+	// If true, no onion service is created and the DHT protocol isn't served, so other peers never add this node to
+	// their routing tables or send it queries. It can still find values and providers.
+	ClientOnly bool
+	Verbose    bool
+	// If set, the DHT is a private network that only peers with the same pre-shared key can connect to. This is the
+	// contents of a standard swarm.key file, see NewSwarmKey.
+	SwarmKey []byte
+	// Tunes the DHT, nil for defaults
+	Kademlia *KademliaConf
+	// Tunes the background routing table maintenance, nil for defaults
+	Maintenance *MaintenanceConf
+	// If set, FindProviders only returns providers it could connect to
+	VerifyProviders *VerifyProvidersConf
+	// How data IDs become DHT keys, nil for defaults
+	DataID *DataIDConf
+	// The connection security layer, defaults to SecurityDefault
+	Security Security
+	// The stream muxer, defaults to MuxerMplex
+	Muxer Muxer
+	// Limits inbound DHT requests from each remote peer, nil for defaults
+	RateLimit *RateLimitConf
+	// How onion addresses are advertised to other peers, defaults to AddrFormatDNS. Only used by implementations with
+	// multiaddrs.
+	AddrFormat AddrFormat
+	// If true, the peer ID is derived from the onion service key and peers are only dialed if their onion matches
+	// their peer ID. Every peer in the DHT must set this.
+	OnionIdentity bool
+	// The onion service key so the node keeps the same onion across restarts. Random if nil. Cannot be set with
+	// OnionIdentity, the onion key is derived from PeerKey then.
+	OnionKey ed25519.KeyPair
+	// The peer's private key in the libp2p marshaled form so it keeps the same peer ID across restarts. Random if
+	// empty. With OnionIdentity, it must be an Ed25519 key and the onion key is derived from it. Implementations
+	// whose peer IDs aren't libp2p ones ignore it.
+	PeerKey []byte
+	// How long to wait for the onion service to be published. Defaults to 1 minute.
+	ListenTimeout time.Duration
+}
+
+// Security is the security layer of connections between peers. Every peer in the DHT must use the same one.
+type Security string
+
+const (
+	// The implementation's default
+	SecurityDefault Security = "default"
+	SecurityNoise   Security = "noise"
+	// Only allowed with DHTConf.OnionIdentity. The onion circuit is already end-to-end encrypted and the transport
+	// confirms the onion is for the peer being dialed. Note, inbound connections are not authenticated.
+	SecurityNone Security = "none"
+)
+
+// AddrFormat is how onion addresses are advertised. Every format is always accepted from other peers.
+type AddrFormat string
+
+const (
+	// In the form /dns4/<onion-id>.onion/tcp/<port>
+	AddrFormatDNS AddrFormat = "dns"
+	// In the form /onion3/<onion-id>:<port>
+	AddrFormatOnion3 AddrFormat = "onion3"
+)
+
+// Muxer is the stream multiplexer of connections between peers. Every peer in the DHT must use the same one.
+type Muxer string
+
+const (
+	MuxerMplex Muxer = "mplex"
+	MuxerYamux Muxer = "yamux"
+)
+
+// DataIDConf is how data IDs given to Provide and FindProviders are turned into DHT keys. Every client of the same
+// application must use the same values. The key is the CID of the hash of "<Namespace>\x00<id>", or just "<id>" if
+// Namespace is empty.
+type DataIDConf struct {
+	// Keeps different applications using the same data IDs from colliding
+	Namespace string
+	// The multihash code, defaults to SHA3-256 (0x16) if 0
+	HashCode uint64
+	// The multicodec of the CID, defaults to raw (0x55) if 0
+	Codec uint64
+	// If true, data IDs are already CIDs in string form, such as from RawStringDataID, and are used as is. The other
+	// fields are ignored.
+	Raw bool
+}
+
+// HashDataID returns the CID that is the DHT key for the data ID. The conf may be nil for defaults.
+func HashDataID(id []byte, conf *DataIDConf) (cid.Cid, error) {
+	hashCode, codec := uint64(multihash.SHA3_256), uint64(cid.Raw)
+	if conf != nil && conf.Raw {
+		if ret, err := cid.Decode(string(id)); err != nil {
+			return cid.Undef, fmt.Errorf("Invalid raw CID: %v", err)
+		} else {
+			return ret, nil
+		}
+	} else if conf != nil {
+		if conf.HashCode != 0 {
+			hashCode = conf.HashCode
+		}
+		if conf.Codec != 0 {
+			codec = conf.Codec
+		}
+		if conf.Namespace != "" {
+			id = append([]byte(conf.Namespace+"\x00"), id...)
+		}
+	}
+	if hash, err := multihash.Sum(id, hashCode, -1); err != nil {
+		return cid.Undef, fmt.Errorf("Failed hashing ID: %v", err)
+	} else {
+		return cid.NewCidV1(codec, hash), nil
+	}
 }
 
+// KademliaConf tunes the DHT for slow links. Zero values use the implementation defaults.
+type KademliaConf struct {
+	// Number of peers per routing table bucket (k). Only used by the kad impl, the ipfs impl ignores it and always
+	// uses 20.
+	BucketSize int
+	// Number of concurrent requests per lookup (alpha). Only used by the kad impl, the ipfs impl ignores it and always
+	// uses 3.
+	Alpha int
+	// Number of closest peers a provider record is stored on
+	Replication int
+	// Timeout for each Provide, FindProviders and bootstrap query. No timeout other than the context's if 0.
+	QueryTimeout time.Duration
+	// The DHT protocol ID. Nodes with a different protocol ID, such as the public IPFS network, are never routed for.
+	ProtocolID string
+}
+
+// MaintenanceConf tunes the background loop that keeps a DHT node connected. Zero values use the defaults.
+type MaintenanceConf struct {
+	// When the routing table has fewer peers than this, the bootstrap peers and recently seen peers are re-dialed.
+	// Defaults to 2.
+	MinRoutingTableSize int
+	// How often the routing table size is checked. Defaults to 30 seconds.
+	CheckInterval time.Duration
+	// How often the routing table buckets are refreshed. Defaults to 5 minutes.
+	RefreshInterval time.Duration
+}
+
+// VerifyProvidersConf has FindProviders dial each provider, only returning the reachable ones, fastest first, with
+// PeerInfo.ConnectLatency set. Zero values use the defaults.
+type VerifyProvidersConf struct {
+	// How many providers are dialed at once. Defaults to 3.
+	Concurrency int
+	// How long to wait for each provider. Defaults to 1 minute.
+	Timeout time.Duration
+}
+
+// RateLimitConf limits inbound DHT requests per remote peer with a token bucket. Requests over the limit are rejected
+// by resetting the stream. The kad implementation limits per inbound conn instead. Zero values use the defaults.
+type RateLimitConf struct {
+	// Sustained requests per second from each peer. Defaults to 10.
+	RequestsPerSecond float64
+	// Requests allowed from each peer at once before the rate applies. Defaults to 50.
+	Burst int
+	// Most provider records stored for each remote peer across all keys. Defaults to 1000.
+	MaxProvidersPerPeer int
+	// If true, there are no limits
+	Disabled bool
+}
+
+type I2PConf struct {
+	// The SAM v3 bridge address. Defaults to 127.0.0.1:7656 if empty.
+	SAMAddr string
+}
+
+// MaxProviderMetadataSize is the largest metadata that can be given to DHT.Provide.
+const MaxProviderMetadataSize = 1024
+
 type DHT interface {
 	io.Closer
 
 	PeerInfo() *PeerInfo
-	Provide(ctx context.Context, id []byte) error
+	Status() *Status
+	// Peers returns the peers currently in the routing table
+	Peers() []*PeerInfo
+	// Provide announces this node as a provider of the ID. The metadata is optional, at most
+	// MaxProviderMetadataSize bytes, and is returned on PeerInfo.Metadata to finders.
+	Provide(ctx context.Context, id []byte, metadata []byte) error
 	FindProviders(ctx context.Context, id []byte, maxCount int) ([]*PeerInfo, error)
 }
 
+// Status is a snapshot of a DHT node's connectivity.
+type Status struct {
+	RoutingTableSize int
+	ConnectedPeers   int
+	// Zero if never happened
+	LastRefresh time.Time
+	// Zero if never happened
+	LastReconnect time.Time
+	// Number of times peers were re-dialed because the routing table was too small
+	Reconnects int
+	// Empty if the last refresh or reconnect succeeded
+	LastError string
+	// Number of inbound DHT requests rejected for being over the peer's rate limit
+	RateLimitedRequests int
+	// Number of inbound provider records rejected for being over the peer's max
+	RejectedProviders int
+}
+
+// LatencyUnmeasured is the PeerInfo.ConnectLatency of verified providers there was nothing to measure for. Those are
+// sorted after the measured ones.
+const LatencyUnmeasured time.Duration = -1
+
 type PeerInfo struct {
-	ID string
-	// May be empty string if not listening
+	// The Impl name and version the peer runs. Empty if unknown, only set on the PeerInfo of DHTs.
+	Impl        string
+	ImplVersion string
+	ID          string
+	// May be empty string if not listening. For I2P peers, this is the full <hash>.b32.i2p address.
 	OnionServiceID string
-	// Invalid value if OnionServiceID is empty
+	// Invalid value if OnionServiceID is empty, always 0 for I2P peers
 	OnionPort int
+	// Only set on FindProviders results when providers are verified. LatencyUnmeasured if the provider is the DHT
+	// itself.
+	ConnectLatency time.Duration
+	// Only set on FindProviders results, what the provider gave to Provide
+	Metadata []byte
 }
 
+// String is "<onion>:<port>/<id>", prefixed with "<impl>@<version>/" if the impl is known.
 func (p *PeerInfo) String() string {
+	if p.Impl != "" {
+		return fmt.Sprintf("%v@%v/%v:%v/%v", p.Impl, p.ImplVersion, p.OnionServiceID, p.OnionPort, p.ID)
+	}
 	return fmt.Sprintf("%v:%v/%v", p.OnionServiceID, p.OnionPort, p.ID)
 }
 
+// IsI2P is true if the peer is reachable over I2P instead of Tor.
+func (p *PeerInfo) IsI2P() bool { return strings.HasSuffix(p.OnionServiceID, ".b32.i2p") }
+
+// NewPeerInfo parses the result of PeerInfo.String.
 func NewPeerInfo(str string) (*PeerInfo, error) {
+	ret := &PeerInfo{}
+	// Take off the impl if it's there
+	if prefix, rest, ok := torutil.PartitionString(str, '/'); ok && strings.Contains(prefix, "@") {
+		ret.Impl, ret.ImplVersion, _ = torutil.PartitionString(prefix, '@')
+		str = rest
+	}
 	if onion, id, ok := torutil.PartitionString(str, '/'); !ok {
 		return nil, fmt.Errorf("Missing ID portion")
 	} else if onionID, portStr, ok := torutil.PartitionString(onion, ':'); !ok {
 		return nil, fmt.Errorf("Missing onion port")
 	} else {
-		ret := &PeerInfo{ID: id, OnionServiceID: onionID}
+		ret.ID, ret.OnionServiceID = id, onionID
 		ret.OnionPort, _ = strconv.Atoi(portStr)
 		return ret, nil
 	}
@@ -0,0 +1,391 @@
+// Package tordhttest has a conformance suite that every tordht.Impl is expected to pass. It runs the DHTs on an
+// in-memory onion network so Tor is not needed.
+package tordhttest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/keyfile"
+)
+
+// How many server nodes each test network has
+const NodeCount = 5
+
+// How long each test has before it fails
+const TestTimeout = 2 * time.Minute
+
+// Run runs the whole contract against the impl as subtests. Call it from the implementation's tests.
+func Run(t *testing.T, impl tordht.Impl) {
+	t.Run("RawStringDataID", func(t *testing.T) { testRawStringDataID(t, impl) })
+	t.Run("Bootstrap", func(t *testing.T) { testBootstrap(t, impl) })
+	t.Run("ProvideFind", func(t *testing.T) { testProvideFind(t, impl) })
+	t.Run("ClientOnly", func(t *testing.T) { testClientOnly(t, impl) })
+	t.Run("VerifyProvidersSelf", func(t *testing.T) { testVerifyProvidersSelf(t, impl) })
+	t.Run("Churn", func(t *testing.T) { testChurn(t, impl) })
+	t.Run("Close", func(t *testing.T) { testClose(t, impl) })
+	t.Run("BadBootstrap", func(t *testing.T) { testBadBootstrap(t, impl) })
+	t.Run("Identity", func(t *testing.T) { testIdentity(t, impl) })
+	t.Run("Capabilities", func(t *testing.T) { testCapabilities(t, impl) })
+}
+
+// Cluster is a set of server nodes on an in-memory network, each bootstrapped from the ones before it.
+type Cluster struct {
+	Impl    tordht.Impl
+	Network *MemoryNetwork
+	Nodes   []tordht.DHT
+	Clients []tordht.DHT
+}
+
+// NewCluster starts count server nodes. The caller must call Close.
+func NewCluster(ctx context.Context, t *testing.T, impl tordht.Impl, count int) *Cluster {
+	c := &Cluster{Impl: impl, Network: NewMemoryNetwork()}
+	for i := 0; i < count; i++ {
+		node, err := impl.NewDHT(ctx, c.Conf(false))
+		if err != nil {
+			c.Close()
+			t.Fatalf("Failed creating node #%v: %v", i+1, err)
+		}
+		c.Nodes = append(c.Nodes, node)
+	}
+	return c
+}
+
+// Close closes all nodes and clients
+func (c *Cluster) Close() {
+	for _, dht := range append(c.Clients, c.Nodes...) {
+		dht.Close()
+	}
+	c.Nodes, c.Clients = nil, nil
+}
+
+// Conf is for a new node on the network bootstrapped from all current nodes
+func (c *Cluster) Conf(clientOnly bool) *tordht.DHTConf {
+	conf := &tordht.DHTConf{
+		Network:    c.Network,
+		ClientOnly: clientOnly,
+		Verbose:    testing.Verbose(),
+	}
+	for _, node := range c.Nodes {
+		conf.BootstrapPeers = append(conf.BootstrapPeers, node.PeerInfo())
+	}
+	return conf
+}
+
+// NewClient starts a client-only node bootstrapped from all current nodes. It is closed with the cluster.
+func (c *Cluster) NewClient(ctx context.Context, t *testing.T) tordht.DHT {
+	client, err := c.Impl.NewDHT(ctx, c.Conf(true))
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+	c.Clients = append(c.Clients, client)
+	return client
+}
+
+func testRawStringDataID(t *testing.T, impl tordht.Impl) {
+	id := []byte("tordhttest")
+	first, err := impl.RawStringDataID(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := impl.RawStringDataID(id, nil); err != nil || second != first {
+		t.Fatalf("Expected %v twice, got %v (err: %v)", first, second, err)
+	}
+	if defaults, err := impl.RawStringDataID(id, &tordht.DataIDConf{}); err != nil || defaults != first {
+		t.Fatalf("Expected empty conf to be the same as nil, got %v (err: %v)", defaults, err)
+	}
+	if namespaced, err := impl.RawStringDataID(id, &tordht.DataIDConf{Namespace: "other"}); err != nil {
+		t.Fatal(err)
+	} else if namespaced == first {
+		t.Fatalf("Expected namespace to change the ID")
+	}
+	if other, err := impl.RawStringDataID([]byte("tordhttest2"), nil); err != nil || other == first {
+		t.Fatalf("Expected different IDs to differ, got %v (err: %v)", other, err)
+	}
+}
+
+func testBootstrap(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, NodeCount)
+	defer c.Close()
+	seen := map[string]bool{}
+	for i, node := range c.Nodes {
+		if info := node.PeerInfo(); info == nil || info.ID == "" || info.OnionServiceID == "" {
+			t.Fatalf("Node #%v missing peer info: %v", i+1, info)
+		} else if info.Impl != impl.Name() || info.ImplVersion != impl.Version() {
+			t.Fatalf("Node #%v peer info has impl %v@%v", i+1, info.Impl, info.ImplVersion)
+		} else if parsed, err := tordht.NewPeerInfo(info.String()); err != nil || parsed.String() != info.String() {
+			t.Fatalf("Node #%v peer info %v didn't parse back, got %v (err: %v)", i+1, info, parsed, err)
+		} else if seen[info.ID] {
+			t.Fatalf("Node #%v has duplicate ID %v", i+1, info.ID)
+		} else if !c.Network.Listening(info.OnionServiceID) {
+			t.Fatalf("Node #%v not listening on %v", i+1, info.OnionServiceID)
+		} else {
+			seen[info.ID] = true
+		}
+		// All but the first bootstrapped from someone
+		if status := node.Status(); i > 0 && status.RoutingTableSize == 0 {
+			t.Fatalf("Node #%v has an empty routing table", i+1)
+		} else if i > 0 && len(node.Peers()) == 0 {
+			t.Fatalf("Node #%v has no peers", i+1)
+		}
+	}
+}
+
+func testProvideFind(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, NodeCount)
+	defer c.Close()
+	id, metadata := []byte("provide-find"), []byte("some metadata")
+	first, last := c.Nodes[0], c.Nodes[len(c.Nodes)-1]
+	if err := first.Provide(ctx, id, metadata); err != nil {
+		t.Fatalf("Failed providing on first: %v", err)
+	} else if err = last.Provide(ctx, id, nil); err != nil {
+		t.Fatalf("Failed providing on last: %v", err)
+	}
+	// Too much metadata fails
+	if err := first.Provide(ctx, id, make([]byte, tordht.MaxProviderMetadataSize+1)); err == nil {
+		t.Fatalf("Expected too much metadata to fail")
+	}
+	providers, err := c.NewClient(ctx, t).FindProviders(ctx, id, 2)
+	if err != nil {
+		t.Fatalf("Failed finding: %v", err)
+	}
+	found := map[string]*tordht.PeerInfo{}
+	for _, provider := range providers {
+		found[provider.ID] = provider
+	}
+	if len(found) != 2 || found[first.PeerInfo().ID] == nil || found[last.PeerInfo().ID] == nil {
+		t.Fatalf("Expected providers %v and %v, got %v", first.PeerInfo(), last.PeerInfo(), providers)
+	} else if provider := found[first.PeerInfo().ID]; provider.OnionServiceID != first.PeerInfo().OnionServiceID ||
+		provider.OnionPort != first.PeerInfo().OnionPort || !bytes.Equal(provider.Metadata, metadata) {
+		t.Fatalf("Expected first provider %v with metadata, got %v (metadata %q)", first.PeerInfo(), provider,
+			provider.Metadata)
+	}
+	// No more than the max even if there are more providers
+	if providers, err = c.NewClient(ctx, t).FindProviders(ctx, id, 1); err != nil || len(providers) != 1 {
+		t.Fatalf("Expected 1 provider, got %v (err: %v)", providers, err)
+	}
+	// Something no one provides has no providers
+	if providers, err = c.NewClient(ctx, t).FindProviders(ctx, []byte("not-provided"), 1); len(providers) > 0 {
+		t.Fatalf("Expected no providers, got %v (err: %v)", providers, err)
+	}
+}
+
+func testClientOnly(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, NodeCount)
+	defer c.Close()
+	client := c.NewClient(ctx, t)
+	if info := client.PeerInfo(); info != nil {
+		t.Fatalf("Expected client to have no peer info, got %v", info)
+	} else if err := client.Provide(ctx, []byte("client-only"), nil); err == nil {
+		t.Fatalf("Expected client provide to fail")
+	}
+	// Other nodes can't be bootstrapped from a client since it has no peer info, but it can still find
+	if err := c.Nodes[1].Provide(ctx, []byte("client-only"), nil); err != nil {
+		t.Fatalf("Failed providing: %v", err)
+	} else if providers, err := client.FindProviders(ctx, []byte("client-only"), 1); err != nil ||
+		len(providers) != 1 {
+		t.Fatalf("Expected 1 provider, got %v (err: %v)", providers, err)
+	}
+	// Even after the client queried them, servers only have each other in their routing tables
+	for i, node := range c.Nodes {
+		if size := node.Status().RoutingTableSize; size > len(c.Nodes)-1 {
+			t.Fatalf("Node #%v has %v peers in its routing table, more than the other servers", i+1, size)
+		}
+	}
+}
+
+func testVerifyProvidersSelf(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, NodeCount)
+	defer c.Close()
+	conf := c.Conf(false)
+	conf.VerifyProviders = &tordht.VerifyProvidersConf{Timeout: 10 * time.Second}
+	self, err := impl.NewDHT(ctx, conf)
+	if err != nil {
+		t.Fatalf("Failed creating node: %v", err)
+	}
+	c.Nodes = append(c.Nodes, self)
+	id, other := []byte("verify-self"), c.Nodes[0]
+	if err := self.Provide(ctx, id, nil); err != nil {
+		t.Fatalf("Failed providing on self: %v", err)
+	} else if err = other.Provide(ctx, id, nil); err != nil {
+		t.Fatalf("Failed providing on other: %v", err)
+	}
+	// The node finding itself isn't measured and comes after the measured ones
+	providers, err := self.FindProviders(ctx, id, 2)
+	if err != nil {
+		t.Fatalf("Failed finding: %v", err)
+	} else if len(providers) != 2 || providers[0].ID != other.PeerInfo().ID || providers[1].ID != self.PeerInfo().ID {
+		t.Fatalf("Expected providers %v then %v, got %v", other.PeerInfo(), self.PeerInfo(), providers)
+	} else if providers[0].ConnectLatency <= 0 {
+		t.Fatalf("Expected a measured latency for other, got %v", providers[0].ConnectLatency)
+	} else if providers[1].ConnectLatency != tordht.LatencyUnmeasured {
+		t.Fatalf("Expected unmeasured latency for self, got %v", providers[1].ConnectLatency)
+	}
+}
+
+func testChurn(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, NodeCount)
+	defer c.Close()
+	id := []byte("churn")
+	first, last := c.Nodes[0], c.Nodes[len(c.Nodes)-1]
+	if err := first.Provide(ctx, id, nil); err != nil {
+		t.Fatalf("Failed providing on first: %v", err)
+	} else if err = last.Provide(ctx, id, nil); err != nil {
+		t.Fatalf("Failed providing on last: %v", err)
+	}
+	// Take the first provider away, then add a new node and have a client that only knows the new node find
+	if err := first.Close(); err != nil {
+		t.Fatalf("Failed closing first: %v", err)
+	}
+	c.Nodes = c.Nodes[1:]
+	newNode, err := impl.NewDHT(ctx, c.Conf(false))
+	if err != nil {
+		t.Fatalf("Failed creating new node: %v", err)
+	}
+	c.Nodes = append(c.Nodes, newNode)
+	conf := &tordht.DHTConf{
+		Network:         c.Network,
+		ClientOnly:      true,
+		BootstrapPeers:  []*tordht.PeerInfo{newNode.PeerInfo()},
+		VerifyProviders: &tordht.VerifyProvidersConf{Timeout: 10 * time.Second},
+	}
+	client, err := impl.NewDHT(ctx, conf)
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+	c.Clients = append(c.Clients, client)
+	// Only the live provider is returned
+	providers, err := client.FindProviders(ctx, id, 2)
+	if err != nil {
+		t.Fatalf("Failed finding: %v", err)
+	} else if len(providers) != 1 || providers[0].ID != last.PeerInfo().ID {
+		t.Fatalf("Expected only provider %v, got %v", last.PeerInfo(), providers)
+	} else if providers[0].ConnectLatency <= 0 {
+		// Measured even if the lookup already connected to it
+		t.Fatalf("Expected a measured latency, got %v", providers[0].ConnectLatency)
+	}
+}
+
+func testClose(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, 2)
+	defer c.Close()
+	node := c.Nodes[1]
+	c.Nodes = c.Nodes[:1]
+	if err := node.Close(); err != nil {
+		t.Fatalf("Failed closing: %v", err)
+	} else if c.Network.Listening(node.PeerInfo().OnionServiceID) {
+		t.Fatalf("Expected onion service to be gone after close")
+	}
+	// Nodes that can only reach the closed one fail to start
+	conf := c.Conf(false)
+	conf.BootstrapPeers = []*tordht.PeerInfo{node.PeerInfo()}
+	if newNode, err := impl.NewDHT(ctx, conf); err == nil {
+		newNode.Close()
+		t.Fatalf("Expected bootstrapping from closed node to fail")
+	}
+}
+
+func testBadBootstrap(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, 1)
+	defer c.Close()
+	if _, err := tordht.NewPeerInfo("not-a-peer"); err == nil {
+		t.Fatalf("Expected invalid peer string to fail")
+	}
+	// Right onion, wrong port
+	badPort := *c.Nodes[0].PeerInfo()
+	badPort.OnionPort++
+	// Onion nothing listens on
+	badOnion := *c.Nodes[0].PeerInfo()
+	badOnion.OnionServiceID = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	// Some other impl
+	badImpl := *c.Nodes[0].PeerInfo()
+	badImpl.Impl = impl.Name() + "-other"
+	for _, peer := range []*tordht.PeerInfo{&badPort, &badOnion, &badImpl} {
+		conf := c.Conf(true)
+		conf.BootstrapPeers = []*tordht.PeerInfo{peer}
+		if client, err := impl.NewDHT(ctx, conf); err == nil {
+			client.Close()
+			t.Fatalf("Expected bootstrapping from %v to fail", peer)
+		}
+	}
+	// No network at all
+	if client, err := impl.NewDHT(ctx, &tordht.DHTConf{ClientOnly: true}); err == nil {
+		client.Close()
+		t.Fatalf("Expected missing network to fail")
+	}
+}
+
+func testIdentity(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, 1)
+	defer c.Close()
+	if _, err := impl.IdentityPeerInfo(c.Conf(false)); err == nil {
+		t.Fatalf("Expected identity without keys to fail")
+	}
+	// The node started with the keys must have the same peer info, other than the port
+	id, err := keyfile.Generate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := c.Conf(false)
+	conf.OnionKey, conf.PeerKey = id.OnionKey, id.PeerKey
+	expected, err := impl.IdentityPeerInfo(conf)
+	if err != nil {
+		t.Fatalf("Failed getting identity peer info: %v", err)
+	}
+	node, err := impl.NewDHT(ctx, conf)
+	if err != nil {
+		t.Fatalf("Failed creating node: %v", err)
+	}
+	c.Nodes = append(c.Nodes, node)
+	actual := *node.PeerInfo()
+	actual.OnionPort = 0
+	if actual.String() != expected.String() {
+		t.Fatalf("Expected peer info %v, got %v", expected, &actual)
+	}
+}
+
+func testCapabilities(t *testing.T, impl tordht.Impl) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancelFn()
+	c := NewCluster(ctx, t, impl, 1)
+	defer c.Close()
+	// Each conf only sets a feature the impl says it doesn't support
+	caps := impl.Capabilities()
+	unsupported := map[string]func(*tordht.DHTConf){}
+	if !caps.I2P {
+		unsupported["I2P"] = func(conf *tordht.DHTConf) { conf.I2P = &tordht.I2PConf{} }
+	}
+	if !caps.SwarmKey {
+		unsupported["SwarmKey"] = func(conf *tordht.DHTConf) { conf.SwarmKey = []byte("swarm key") }
+	}
+	if !caps.PeerCache {
+		unsupported["PeerCache"] = func(conf *tordht.DHTConf) { conf.PeerCacheFile = "peers.json" }
+	}
+	for name, apply := range unsupported {
+		conf := c.Conf(false)
+		apply(conf)
+		if node, err := impl.NewDHT(ctx, conf); err == nil {
+			node.Close()
+			t.Fatalf("Expected unsupported %v to fail", name)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package tordhttest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht"
+)
+
+// MemoryNetwork is an in-process tordht.OnionNetwork. Onion IDs are derived from the keys like real v3 onions, but
+// conns are in-memory pipes. Safe for concurrent use.
+type MemoryNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+var _ tordht.OnionNetwork = &MemoryNetwork{}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: map[string]*memoryListener{}, nextPort: 10000}
+}
+
+func (m *MemoryNetwork) Dial(ctx context.Context, onionServiceID string, port int) (net.Conn, error) {
+	m.lock.Lock()
+	l := m.listeners[onionServiceID]
+	m.lock.Unlock()
+	if l == nil || l.port != port {
+		return nil, fmt.Errorf("Nothing listening on %v:%v", onionServiceID, port)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener on %v:%v closed", onionServiceID, port)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *MemoryNetwork) Listen(ctx context.Context, key ed25519.KeyPair) (tordht.OnionListener, error) {
+	if key == nil {
+		return nil, fmt.Errorf("Missing key")
+	}
+	onionID := torutil.OnionServiceIDFromV3PublicKey(key.PublicKey())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.listeners[onionID] != nil {
+		return nil, fmt.Errorf("Already listening on %v", onionID)
+	}
+	m.nextPort++
+	l := &memoryListener{
+		network: m,
+		onionID: onionID,
+		port:    m.nextPort,
+		accept:  make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	m.listeners[onionID] = l
+	return l, nil
+}
+
+// Listening is whether there is a listener for the onion
+func (m *MemoryNetwork) Listening(onionServiceID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.listeners[onionServiceID] != nil
+}
+
+type memoryListener struct {
+	network   *MemoryNetwork
+	onionID   string
+	port      int
+	accept    chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (m *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.accept:
+		return conn, nil
+	case <-m.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+func (m *memoryListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.network.lock.Lock()
+		defer m.network.lock.Unlock()
+		if m.network.listeners[m.onionID] == m {
+			delete(m.network.listeners, m.onionID)
+		}
+	})
+	return nil
+}
+
+func (m *memoryListener) Addr() net.Addr {
+	return memoryAddr(fmt.Sprintf("%v.onion:%v", m.onionID, m.port))
+}
+
+func (m *memoryListener) OnionServiceID() string { return m.onionID }
+func (m *memoryListener) OnionPort() int         { return m.port }
+
+type memoryAddr string
+
+func (memoryAddr) Network() string  { return "memory" }
+func (m memoryAddr) String() string { return string(m) }
@@ -0,0 +1,50 @@
+package tordht
+
+import (
+	"context"
+	"time"
+)
+
+type traceKey struct{}
+
+// WithTrace returns a context that has Provide and FindProviders record the peers they contact into the returned
+// trace. The trace must not be read until the call returns.
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	trace := &Trace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// TraceFromContext returns the trace set with WithTrace or nil if there isn't one. For use by implementations.
+func TraceFromContext(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// Trace is the path of a DHT query.
+type Trace struct {
+	// The DHT key queried
+	Key      string
+	Started  time.Time
+	Finished time.Time
+	// In the order they were first seen
+	Peers []*TracePeer
+	// Empty if the query succeeded
+	Error string
+}
+
+// TracePeer is a peer seen during a DHT query.
+type TracePeer struct {
+	ID string
+	// 0 for peers we knew before the query, otherwise one more than the hop of the peer that told us about it
+	Hop int
+	// Empty for peers we knew before the query
+	LearnedFrom string
+	// Zero if the peer was never asked
+	Queried time.Time
+	// How long until the peer replied, 0 if it didn't
+	Latency time.Duration
+	// Empty if the peer replied or was never asked
+	Error string
+	// The peer IDs it replied with
+	CloserPeers []string `json:",omitempty"`
+}
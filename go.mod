@@ -0,0 +1,36 @@
+module github.com/cretz/tor-dht-poc
+
+go 1.13
+
+require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/cretz/bine v0.1.0
+	github.com/gogo/protobuf v1.3.1
+	github.com/gorilla/websocket v1.4.2
+	github.com/ipfs/go-cid v0.0.5
+	github.com/ipfs/go-datastore v0.4.4
+	github.com/ipfs/go-ipfs-addr v0.0.1
+	github.com/ipfs/go-log v1.0.3
+	github.com/libp2p/go-libp2p v0.8.1
+	github.com/libp2p/go-libp2p-core v0.5.1
+	github.com/libp2p/go-libp2p-crypto v0.1.0
+	github.com/libp2p/go-libp2p-host v0.1.0
+	github.com/libp2p/go-libp2p-kad-dht v0.2.1
+	github.com/libp2p/go-libp2p-mplex v0.2.3
+	github.com/libp2p/go-libp2p-net v0.1.0
+	github.com/libp2p/go-libp2p-noise v0.1.1
+	github.com/libp2p/go-libp2p-peer v0.2.0
+	github.com/libp2p/go-libp2p-peerstore v0.2.2
+	github.com/libp2p/go-libp2p-protocol v0.1.0
+	github.com/libp2p/go-libp2p-routing v0.1.0
+	github.com/libp2p/go-libp2p-transport v0.1.0
+	github.com/libp2p/go-libp2p-transport-upgrader v0.2.0
+	github.com/libp2p/go-libp2p-yamux v0.2.7
+	github.com/multiformats/go-multiaddr v0.2.1
+	github.com/multiformats/go-multiaddr-dns v0.2.0
+	github.com/multiformats/go-multiaddr-net v0.1.4
+	github.com/multiformats/go-multibase v0.0.1
+	github.com/multiformats/go-multihash v0.0.13
+	github.com/whyrusleeping/mafmt v1.2.8
+	golang.org/x/crypto v0.0.0-20200423211502-4bdfaf469ed5
+)
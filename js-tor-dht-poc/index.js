@@ -52,8 +52,15 @@ if (!window.tordhtpoc) window.tordhtpoc = (function() {
   }
 
   function peerToIpfsAddress(peer) {
-    // Peer is in form like <onion-id>:<port>/<ipfs-id>
+    // Peer is in form like <onion-id>:<port>/<ipfs-id>, optionally prefixed with <impl>@<version>/
     // Need to change to /dns4/<onion-id>.onion/tcp/<port>/ws/ipfs/<ipfs-id>
+    const firstSlashIndex = peer.indexOf('/')
+    const atIndex = peer.indexOf('@')
+    if (atIndex != -1 && atIndex < firstSlashIndex) {
+      const impl = peer.substring(0, atIndex)
+      if (impl != 'ipfs') throw new Error('Peer is running implementation ' + impl + ', only ipfs is supported')
+      peer = peer.substring(firstSlashIndex + 1)
+    }
     const slashIndex = peer.lastIndexOf('/')
     if (slashIndex == -1) throw new Error('No slash')
     const colonIndex = peer.lastIndexOf(':', slashIndex)
@@ -70,15 +77,44 @@ if (!window.tordhtpoc) window.tordhtpoc = (function() {
     return tuples[0][1] + ':' + tuples[1][1] + '/' + id
   }
 
+  function loadConfig() {
+    // Written by go-tor-dht-poc rawid -browser-config, served by main.go
+    console.log('Loading config')
+    fetch('config.json').then(resp => {
+      if (!resp.ok) throw new Error('Status ' + resp.status)
+      return resp.json()
+    }).then(config => {
+      console.log('Loaded config', config)
+      const select = document.getElementById('select-key')
+      config.keys.forEach(key => {
+        const option = document.createElement('option')
+        option.value = key.cid
+        option.text = key.key + ' (' + key.cid + ')'
+        select.appendChild(option)
+      })
+      const textPeer = document.getElementById('text-peer')
+      if (!textPeer.value && config.bootstrapPeers.length > 0) textPeer.value = config.bootstrapPeers[0]
+    }).catch(err => {
+      console.log('Failed loading config', err)
+      document.getElementById('find-results').innerHTML = 'Failed loading config: ' + err
+    })
+  }
+
   return {
     debugEnable: (str) => debug.enable(str),
     bodyOnLoad: () => {
+      loadConfig()
       console.log('Attaching DOM handlers')
       document.getElementById('button-find').onclick = () => {
+        const cid = document.getElementById('select-key').value
+        if (!cid) {
+          document.getElementById('find-results').innerHTML = 'No key to find, is the config loaded?'
+          return
+        }
         // Clear out the results
         document.getElementById('find-results').innerHTML = 'Please wait...'
         // Run the find and put new results
-        tordhtpoc.findProviders(document.getElementById('text-peer').value, (err, peers) => {
+        tordhtpoc.findProviders(document.getElementById('text-peer').value, cid, (err, peers) => {
           let newHtml
           if (err) {
             newHtml = 'Error finding peers: ' + err
@@ -90,8 +126,8 @@ if (!window.tordhtpoc) window.tordhtpoc = (function() {
         })
       }
     },
-    findProviders: (bootstrapPeer, origCallback) => {
-      console.log('Finding providers starting from bootstrap', bootstrapPeer)
+    findProviders: (bootstrapPeer, cid, origCallback) => {
+      console.log('Finding providers of', cid, 'starting from bootstrap', bootstrapPeer)
       PeerInfo.create((err, peerInfo) => {
         if (err) return origCallback(err)
         const node = new Node(peerInfo, bootstrapPeer)
@@ -123,7 +159,7 @@ if (!window.tordhtpoc) window.tordhtpoc = (function() {
               if (firstRouteAdd) {
                 firstRouteAdd = false
                 console.log('Finding providers')
-                node.contentRouting.findProviders(new CID('zSZ2t1xfC1BLUsxYf9p3ZMwdi1rdvpi4nKveRqujSLoMzFGGb'), 60000, (err, peers) => {
+                node.contentRouting.findProviders(new CID(cid), 60000, (err, peers) => {
                   console.log('Find complete', err, peers)
                   callback(err, peers)
                 })
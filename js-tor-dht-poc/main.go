@@ -2,20 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/cretz/bine/tor"
-
-	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/cretz/tor-dht-poc/go-tor-dht-poc/tordht/keyfile"
 )
 
 const debug = false
 
+// Written by go-tor-dht-poc rawid -browser-config, served as /config.json
+const browserConfigFile = "browser-config.json"
+
 func main() {
 	if err := run(); err != nil {
 		log.Fatal(err)
@@ -27,7 +27,7 @@ func run() error {
 	defer cancelFn()
 
 	// Create/load key
-	key, err := createOrLoadKey()
+	key, err := keyfile.LoadOrCreateOnionKey("onion.pem")
 	if err != nil {
 		return fmt.Errorf("Failed creating or loading key: %v", err)
 	}
@@ -56,9 +56,17 @@ func run() error {
 
 	fmt.Printf("Open Tor browser and navigate to http://%v.onion\n", onion.ID)
 	fmt.Printf("Press enter to exit")
-	// Serve the current folder from HTTP
+	// Serve the public folder and the config from HTTP
+	if _, err = os.Stat(browserConfigFile); err != nil {
+		log.Printf("Missing %v, the page won't have any keys to find: %v", browserConfigFile, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("public")))
+	mux.HandleFunc("/config.json", func(w http.ResponseWriter, req *http.Request) {
+		http.ServeFile(w, req, browserConfigFile)
+	})
 	errCh := make(chan error, 1)
-	go func() { errCh <- http.Serve(onion, http.FileServer(http.Dir("public"))) }()
+	go func() { errCh <- http.Serve(onion, mux) }()
 	// End when enter is pressed
 	go func() {
 		fmt.Scanln()
@@ -69,20 +77,3 @@ func run() error {
 	}
 	return nil
 }
-
-func createOrLoadKey() (ed25519.KeyPair, error) {
-	if byts, err := ioutil.ReadFile("onion.pem"); err == nil {
-		if block, _ := pem.Decode(byts); block == nil || block.Type != "PRIVATE KEY" {
-			return nil, fmt.Errorf("Invalid block")
-		} else {
-			return ed25519.PrivateKey(block.Bytes).KeyPair(), nil
-		}
-	} else if !os.IsNotExist(err) {
-		return nil, fmt.Errorf("Error loading file: %v", err)
-	} else if key, err := ed25519.GenerateKey(nil); err != nil {
-		return nil, fmt.Errorf("Failed generating key: %v", err)
-	} else {
-		block := &pem.Block{Type: "PRIVATE KEY", Bytes: key.PrivateKey()}
-		return key, ioutil.WriteFile("onion.pem", pem.EncodeToMemory(block), 0600)
-	}
-}